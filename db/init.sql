@@ -1,11 +1,103 @@
 CREATE DATABASE compman_db;
 \c compman_db;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
 CREATE TABLE IF NOT EXISTS companies (
                            id UUID PRIMARY KEY,
-                           name VARCHAR(15) NOT NULL UNIQUE,
+                           name VARCHAR(15) NOT NULL,
                            description VARCHAR(3000),
                            employee_count INT NOT NULL,
-                           registered BOOLEAN NOT NULL,
-                           type INT NOT NULL
+                           state INT NOT NULL DEFAULT 0,
+                           type INT NOT NULL,
+                           created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           created_by VARCHAR(255) NOT NULL DEFAULT '',
+                           updated_by VARCHAR(255) NOT NULL DEFAULT '',
+                           merged_into UUID,
+                           lei CHAR(20),
+                           vat VARCHAR(16),
+                           registry_country CHAR(2),
+                           registry_number VARCHAR(64),
+                           norm_name TEXT NOT NULL DEFAULT ''
 );
+CREATE INDEX IF NOT EXISTS companies_updated_at_idx ON companies (updated_at);
+-- merged duplicates keep their name, it is only unique between the other companies
+CREATE UNIQUE INDEX IF NOT EXISTS companies_name_idx ON companies (name) WHERE merged_into IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS companies_lei_idx ON companies (lei) WHERE merged_into IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS companies_vat_idx ON companies (vat) WHERE merged_into IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS companies_registry_idx ON companies (registry_country, registry_number) WHERE merged_into IS NULL;
+-- duplicate candidates are the nearest normalised names by trigram distance
+CREATE INDEX IF NOT EXISTS companies_norm_name_idx ON companies USING gist (norm_name gist_trgm_ops) WHERE merged_into IS NULL;
+CREATE TABLE IF NOT EXISTS company_history (
+                           version BIGSERIAL PRIMARY KEY,
+                           id UUID NOT NULL,
+                           name VARCHAR(15) NOT NULL,
+                           description VARCHAR(3000),
+                           employee_count INT NOT NULL,
+                           state INT NOT NULL,
+                           type INT NOT NULL,
+                           created_at TIMESTAMPTZ NOT NULL,
+                           updated_at TIMESTAMPTZ NOT NULL,
+                           created_by VARCHAR(255) NOT NULL,
+                           updated_by VARCHAR(255) NOT NULL,
+                           merged_into UUID,
+                           lei CHAR(20),
+                           vat VARCHAR(16),
+                           registry_country CHAR(2),
+                           registry_number VARCHAR(64),
+                           valid_from TIMESTAMPTZ NOT NULL,
+                           valid_to TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS company_history_id_idx ON company_history (id, valid_from);
+
+CREATE TABLE IF NOT EXISTS change_requests (
+                           id UUID PRIMARY KEY,
+                           company_id UUID NOT NULL,
+                           kind VARCHAR(16) NOT NULL,
+                           changes JSONB,
+                           status INT NOT NULL DEFAULT 0,
+                           proposed_by VARCHAR(255) NOT NULL,
+                           proposed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           decided_by VARCHAR(255),
+                           decided_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS change_requests_company_idx ON change_requests (company_id, status);
 
+CREATE TABLE IF NOT EXISTS scheduled_changes (
+                           id UUID PRIMARY KEY,
+                           company_id UUID NOT NULL,
+                           changes JSONB NOT NULL,
+                           effective_at TIMESTAMPTZ NOT NULL,
+                           status INT NOT NULL DEFAULT 0,
+                           created_by VARCHAR(255) NOT NULL,
+                           created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           applied_at TIMESTAMPTZ,
+                           error TEXT
+);
+CREATE INDEX IF NOT EXISTS scheduled_changes_due_idx ON scheduled_changes (status, effective_at);
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+                           key VARCHAR(512) PRIMARY KEY,
+                           fingerprint CHAR(64) NOT NULL,
+                           status INT NOT NULL DEFAULT 0,
+                           content_type VARCHAR(255),
+                           body BYTEA,
+                           created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
+CREATE TABLE IF NOT EXISTS jobs (
+                           id UUID PRIMARY KEY,
+                           kind VARCHAR(32) NOT NULL,
+                           params JSONB NOT NULL,
+                           status INT NOT NULL DEFAULT 0,
+                           progress_done INT NOT NULL DEFAULT 0,
+                           progress_total INT NOT NULL DEFAULT 0,
+                           result JSONB,
+                           error TEXT,
+                           created_by VARCHAR(255) NOT NULL,
+                           created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                           started_at TIMESTAMPTZ,
+                           finished_at TIMESTAMPTZ,
+                           heartbeat_at TIMESTAMPTZ,
+                           claim UUID
+);
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, created_at);
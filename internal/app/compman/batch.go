@@ -0,0 +1,323 @@
+package compman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+)
+
+// batchRun holds the state shared by the operations of a batch
+type batchRun struct {
+	// force skips the duplicate check of creates
+	force bool
+}
+
+// batchStatus returns the status the endpoint of a batch operation would
+// answer with on err
+func batchStatus(err error) int {
+	var he *httpsrv.Error
+	if errors.As(httpError(err), &he) {
+		return he.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// failed sets the status and error of the result of a failed operation
+func failed(res *types.BatchResult, err error) {
+	res.Status = batchStatus(err)
+	res.Error = err.Error()
+	var ve *types.ValidationError
+	if errors.As(err, &ve) {
+		res.Errors = ve.Fields
+	}
+}
+
+// companyBatchHandler applies the create, patch and delete operations of a
+// batch in order. Atomic batches run in a single transaction, the first
+// failing operation rolls back the batch and the response gets its status,
+// the other operations report 424. Otherwise every operation is committed
+// on its own and the response is 200 with the status of each operation.
+// Events are published for committed operations only.
+func (c *ServiceComponent) companyBatchHandler(w http.ResponseWriter, r *http.Request) error {
+	var batch types.CompanyBatch
+	err := httpsrv.DecodeJSON(r, &batch)
+	if err != nil {
+		return err
+	}
+	if err = batch.Validate(); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	for _, o := range batch.Operations {
+		if o.Op == types.BatchCreate {
+			continue
+		}
+		if err = uuid.Validate(o.ID); err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+	}
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	run := &batchRun{force: r.URL.Query().Get("force") == "true"}
+	rv := types.CompanyBatchResult{Atomic: batch.Atomic, Results: make([]*types.BatchResult, len(batch.Operations))}
+	status := http.StatusOK
+	// the error rolling back an atomic batch is returned once answered, so
+	// that it is logged
+	var batchErr error
+	if batch.Atomic {
+		status, batchErr = c.runAtomicBatch(ctx, run, batch.Operations, rv.Results)
+	} else {
+		for n := range batch.Operations {
+			rv.Results[n] = c.runBatchOperation(ctx, run, &batch.Operations[n])
+		}
+	}
+	b, err := json.Marshal(&rv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	return batchErr
+}
+
+// runAtomicBatch applies the operations in one transaction, filling in their
+// results. It returns the status of the batch and the error rolling it back.
+func (c *ServiceComponent) runAtomicBatch(ctx context.Context, run *batchRun, ops []types.BatchOperation,
+	results []*types.BatchResult) (int, error) {
+	// rollback reports the failure of operation n to the other operations,
+	// or the failure of the whole batch to every operation if n is negative,
+	// e.g. when the commit fails
+	rollback := func(n int, err error) (int, error) {
+		status := http.StatusFailedDependency
+		msg := fmt.Sprintf("batch rolled back, operation %d failed", n)
+		if n < 0 {
+			status = batchStatus(err)
+			msg = fmt.Sprintf("batch rolled back, %v", err)
+		}
+		for i := range results {
+			if i == n {
+				continue
+			}
+			results[i] = &types.BatchResult{Op: ops[i].Op, ID: ops[i].ID, Status: status, Error: msg}
+		}
+		if n < 0 {
+			return status, err
+		}
+		return results[n].Status, err
+	}
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return rollback(-1, err)
+	}
+	defer tx.Rollback(ctx)
+	evts := []kp.KEvent{}
+	for n := range ops {
+		var e []kp.KEvent
+		results[n], e = c.applyBatchOperation(ctx, tx, run, &ops[n])
+		if len(results[n].Error) > 0 {
+			return rollback(n, fmt.Errorf("operation %d failed, %s", n, results[n].Error))
+		}
+		evts = append(evts, e...)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return rollback(-1, err)
+	}
+	if len(evts) > 0 {
+		c.publishCommitted(ctx, evts...)
+	}
+	return http.StatusOK, nil
+}
+
+// runBatchOperation applies the operation of a non-atomic batch in its own
+// transaction
+func (c *ServiceComponent) runBatchOperation(ctx context.Context, run *batchRun,
+	o *types.BatchOperation) *types.BatchResult {
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		res := &types.BatchResult{Op: o.Op, ID: o.ID}
+		failed(res, err)
+		return res
+	}
+	defer tx.Rollback(ctx)
+	res, evts := c.applyBatchOperation(ctx, tx, run, o)
+	if len(res.Error) > 0 {
+		return res
+	}
+	if err = tx.Commit(ctx); err != nil {
+		failed(res, err)
+		return res
+	}
+	if len(evts) > 0 {
+		c.publishCommitted(ctx, evts...)
+	}
+	return res
+}
+
+// applyBatchOperation applies the operation through tx, returning its result
+// and the events to publish once committed
+func (c *ServiceComponent) applyBatchOperation(ctx context.Context, tx store.Tx, run *batchRun,
+	o *types.BatchOperation) (*types.BatchResult, []kp.KEvent) {
+	res := &types.BatchResult{Op: o.Op, ID: o.ID}
+	e, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		failed(res, err)
+		return res, nil
+	}
+	defer c.logQueries(e)
+	var evt kp.KEvent
+	switch o.Op {
+	case types.BatchCreate:
+		evt, err = c.batchCreate(ctx, e, run, o, res)
+	case types.BatchPatch:
+		evt, err = c.batchPatch(ctx, tx, e, o, res)
+	case types.BatchDelete:
+		evt, err = c.batchDelete(ctx, tx, e, o, res)
+	}
+	if err != nil {
+		failed(res, err)
+		return res, nil
+	}
+	if evt == nil {
+		return res, nil
+	}
+	return res, []kp.KEvent{evt}
+}
+
+func (c *ServiceComponent) batchCreate(ctx context.Context, e store.Entity, run *batchRun, o *types.BatchOperation,
+	res *types.BatchResult) (kp.KEvent, error) {
+	var company types.Company
+	if err := httpsrv.UnmarshalJSON(o.Company, &company); err != nil {
+		return nil, fmt.Errorf("%w, %v", postgres.ErrInvalidArg, err)
+	}
+	if err := company.Validate(); err != nil {
+		return nil, err
+	}
+	company.ID = uuid.NewString()
+	prepareNewCompany(&company)
+	if !run.force {
+		// the companies created by the batch so far are selected through the
+		// transaction too
+		var err error
+		if res.Candidates, err = findDuplicates(ctx, e, company.Name); err != nil {
+			return nil, err
+		}
+		if len(res.Candidates) > 0 {
+			return nil, fmt.Errorf("%w, company '%s' has %d likely duplicates", postgres.ErrDuplicate,
+				company.Name, len(res.Candidates))
+		}
+	}
+	b, err := json.Marshal(&company)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.PrepareInsert(b); err != nil {
+		return nil, err
+	}
+	if err = e.Insert(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	res.Company = i.([]*types.Company)[0]
+	res.ID = res.Company.ID
+	res.Status = http.StatusOK
+	return types.NewKafkaCompanyEvent(res.Company, "insert")
+}
+
+// batchPatch applies the patch as PATCH does, changes requiring approval are
+// proposed and changes taking effect in the future scheduled
+func (c *ServiceComponent) batchPatch(ctx context.Context, tx store.Tx, e store.Entity, o *types.BatchOperation,
+	res *types.BatchResult) (kp.KEvent, error) {
+	company, err := selectCompany(ctx, e, o.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	from, err := types.CompanyDocument(company)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := types.CompanyDocument(company)
+	if err != nil {
+		return nil, err
+	}
+	to, effectiveAt, err := applyPatch(o.PatchMediaType(), o.Patch, doc)
+	if err != nil {
+		return nil, err
+	}
+	m := types.PatchChanges(from, to)
+	if err = types.NormalizePatch(company, m); err != nil {
+		return nil, err
+	}
+	scheduled := effectiveAt.After(time.Now())
+	if types.RequiresApproval(types.ChangeKindUpdate, m) {
+		if scheduled {
+			m[types.EffectiveAtKey] = effectiveAt
+		}
+		return c.batchPropose(ctx, tx, o.ID, types.ChangeKindUpdate, m, res)
+	}
+	if scheduled {
+		if res.ScheduledChange, err = c.insertScheduledChange(ctx, tx, o.ID, m, effectiveAt); err != nil {
+			return nil, err
+		}
+		res.Status = http.StatusAccepted
+		return nil, nil
+	}
+	var evt kp.KEvent
+	if res.Company, evt, err = updateCompany(ctx, e, company, m); err != nil {
+		return nil, err
+	}
+	res.Status = http.StatusOK
+	return evt, nil
+}
+
+// batchDelete proposes the deletion, as DELETE does
+func (c *ServiceComponent) batchDelete(ctx context.Context, tx store.Tx, e store.Entity, o *types.BatchOperation,
+	res *types.BatchResult) (kp.KEvent, error) {
+	if _, err := selectCompany(ctx, e, o.ID, false); err != nil {
+		return nil, err
+	}
+	return c.batchPropose(ctx, tx, o.ID, types.ChangeKindDelete, nil, res)
+}
+
+func (c *ServiceComponent) batchPropose(ctx context.Context, tx store.Tx, id string, kind string,
+	changes map[string]interface{}, res *types.BatchResult) (kp.KEvent, error) {
+	cr, err := c.insertChangeRequest(ctx, tx, id, kind, changes)
+	if err != nil {
+		return nil, err
+	}
+	res.ChangeRequest = cr
+	res.Status = http.StatusAccepted
+	return types.NewKafkaChangeRequestEvent(cr, types.OpChangeRequestCreated)
+}
+
+// selectCompany returns the company id through e, locked until the end of
+// the transaction if lock is set
+func selectCompany(ctx context.Context, e store.Entity, id string, lock bool) (*types.Company, error) {
+	if err := e.PrepareSelect(map[string]interface{}{types.FilterID: id, types.FilterLock: lock}); err != nil {
+		return nil, err
+	}
+	if err := e.Select(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	l := i.([]*types.Company)
+	if len(l) == 0 {
+		return nil, postgres.ErrNotFound
+	}
+	return l[0], nil
+}
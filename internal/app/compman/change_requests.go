@@ -0,0 +1,308 @@
+package compman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+)
+
+func (c *ServiceComponent) logQueries(entities ...store.Entity) {
+	for _, e := range entities {
+		for _, entry := range e.QueryLog() {
+			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
+		}
+	}
+}
+
+// proposeChange stores a change of company id as a pending change request,
+// answering with 202 and the change request
+func (c *ServiceComponent) proposeChange(w http.ResponseWriter, r *http.Request, id string, kind string,
+	changes map[string]interface{}) error {
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	ce, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(ce)
+	if err = ce.PrepareSelect(map[string]interface{}{types.FilterID: id}); err != nil {
+		return err
+	}
+	if err = ce.Select(ctx); err != nil {
+		return err
+	}
+	if i, _ := ce.Value(); len(i.([]*types.Company)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	rv, err := c.insertChangeRequest(ctx, tx, id, kind, changes)
+	if err != nil {
+		return err
+	}
+	evt, err := types.NewKafkaChangeRequestEvent(rv, types.OpChangeRequestCreated)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	c.publishCommitted(ctx, evt)
+	b, err := json.Marshal(rv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+	return nil
+}
+
+// insertChangeRequest stores a change of company id as a pending change
+// request in tx
+func (c *ServiceComponent) insertChangeRequest(ctx context.Context, tx store.Tx, id string, kind string,
+	changes map[string]interface{}) (*types.ChangeRequest, error) {
+	cre, err := tx.NewEntity(&types.ChangeRequest{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.logQueries(cre)
+	cr := types.ChangeRequest{ID: uuid.NewString(), CompanyID: id, Kind: kind}
+	if changes != nil {
+		cr.Changes = map[string]interface{}{}
+		for k, v := range changes {
+			if k != "id" {
+				cr.Changes[k] = v
+			}
+		}
+	}
+	if err = cre.PrepareInsert(&cr); err != nil {
+		return nil, err
+	}
+	if err = cre.Insert(ctx); err != nil {
+		return nil, err
+	}
+	i, err := cre.Value()
+	if err != nil {
+		return nil, err
+	}
+	return i.([]*types.ChangeRequest)[0], nil
+}
+
+func (c *ServiceComponent) changeRequestListHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	filter := map[string]interface{}{types.FilterCompanyID: id}
+	if v := r.URL.Query().Get(types.FilterStatus); len(v) > 0 {
+		status := types.ParseChangeRequestStatus(v)
+		if status == -1 {
+			return httpsrv.NewError(http.StatusBadRequest, fmt.Errorf("invalid change request status '%s'", v))
+		}
+		filter[types.FilterStatus] = status
+	}
+	e, err := c.st.NewEntity(&types.ChangeRequest{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(filter); err != nil {
+		return err
+	}
+	if err = e.Select(r.Context()); err != nil {
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+func (c *ServiceComponent) changeRequestApproveHandler(w http.ResponseWriter, r *http.Request) error {
+	return c.decideChangeRequest(w, r, types.ChangeRequestApproved)
+}
+
+func (c *ServiceComponent) changeRequestRejectHandler(w http.ResponseWriter, r *http.Request) error {
+	return c.decideChangeRequest(w, r, types.ChangeRequestRejected)
+}
+
+// decideChangeRequest approves or rejects a pending change request, approved
+// changes are applied to the company in the same transaction
+func (c *ServiceComponent) decideChangeRequest(w http.ResponseWriter, r *http.Request,
+	status types.ChangeRequestStatus) error {
+	ids := httpsrv.GetIdList(r)
+	for _, id := range ids {
+		if err := uuid.Validate(id); err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+	}
+	companyID, crID := ids[0], ids[1]
+	user := httpsrv.User(r)
+	ctx := store.WithActor(r.Context(), user)
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	ce, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	cre, err := tx.NewEntity(&types.ChangeRequest{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(ce, cre)
+	if err = cre.PrepareSelect(map[string]interface{}{
+		types.FilterID:        crID,
+		types.FilterCompanyID: companyID,
+		types.FilterLock:      true,
+	}); err != nil {
+		return err
+	}
+	if err = cre.Select(ctx); err != nil {
+		return err
+	}
+	i, err := cre.Value()
+	if err != nil {
+		return err
+	}
+	if len(i.([]*types.ChangeRequest)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	cr := i.([]*types.ChangeRequest)[0]
+	if cr.Status != types.ChangeRequestPending {
+		return httpsrv.NewError(http.StatusConflict, fmt.Errorf("change request is already %s", cr.Status))
+	}
+	evts := []kp.KEvent{}
+	if status == types.ChangeRequestApproved {
+		if cr.ProposedBy == user {
+			return httpsrv.NewError(http.StatusForbidden, errors.New("change request can not be approved by its proposer"))
+		}
+		var evt kp.KEvent
+		if evt, err = c.applyChangeRequest(ctx, tx, ce, cr); err != nil {
+			if errors.Is(err, postgres.ErrNotFound) || errors.Is(err, postgres.ErrDuplicate) {
+				return httpsrv.NewError(http.StatusConflict, err)
+			} else if errors.Is(err, postgres.ErrInvalidArg) || errors.Is(err, errInvalidChange) {
+				return httpsrv.NewError(http.StatusUnprocessableEntity, err)
+			}
+			return err
+		}
+		if evt != nil {
+			evts = append(evts, evt)
+		}
+	}
+	if err = cre.PrepareUpdate(map[string]interface{}{"id": crID, "status": status}); err != nil {
+		return err
+	}
+	if err = cre.Update(ctx); err != nil {
+		return err
+	}
+	if i, err = cre.Value(); err != nil {
+		return err
+	}
+	cr = i.([]*types.ChangeRequest)[0]
+	op := types.OpChangeRequestApproved
+	if status == types.ChangeRequestRejected {
+		op = types.OpChangeRequestRejected
+	}
+	crEvt, err := types.NewKafkaChangeRequestEvent(cr, op)
+	if err != nil {
+		return err
+	}
+	evts = append(evts, crEvt)
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	c.publishCommitted(ctx, evts...)
+	b, err := json.Marshal(cr)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+var errInvalidChange = errors.New("invalid change")
+
+// applyChangeRequest applies the approved change through the company entity e
+// of tx, returning the company event to publish. Updates taking effect in the
+// future are scheduled instead, without event.
+func (c *ServiceComponent) applyChangeRequest(ctx context.Context, tx store.Tx, e store.Entity,
+	cr *types.ChangeRequest) (kp.KEvent, error) {
+	var op string
+	switch cr.Kind {
+	case types.ChangeKindUpdate:
+		m := map[string]interface{}{}
+		for k, v := range cr.Changes {
+			m[k] = v
+		}
+		effectiveAt, err := types.PopEffectiveAt(m)
+		if err != nil {
+			return nil, fmt.Errorf("%w, %v", errInvalidChange, err)
+		}
+		company, err := selectCompany(ctx, e, cr.CompanyID, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := types.NormalizePatch(company, m); err != nil {
+			return nil, fmt.Errorf("%w, %v", errInvalidChange, err)
+		}
+		if effectiveAt.After(time.Now()) {
+			return nil, c.scheduleApprovedChange(ctx, tx, cr, m, effectiveAt)
+		}
+		if err := e.PrepareUpdate(m); err != nil {
+			return nil, err
+		}
+		if err := e.Update(ctx); err != nil {
+			return nil, err
+		}
+		op = types.ChangeKindUpdate
+	case types.ChangeKindDelete:
+		if err := e.PrepareDelete(map[string]interface{}{"id": cr.CompanyID}); err != nil {
+			return nil, err
+		}
+		if err := e.Delete(ctx); err != nil {
+			return nil, err
+		}
+		op = types.ChangeKindDelete
+	default:
+		return nil, fmt.Errorf("%w, unknown kind '%s'", errInvalidChange, cr.Kind)
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	return types.NewKafkaCompanyEvent(i.([]*types.Company)[0], op)
+}
+
+func (c *ServiceComponent) scheduleApprovedChange(ctx context.Context, tx store.Tx, cr *types.ChangeRequest,
+	m map[string]interface{}, effectiveAt time.Time) error {
+	// the scheduled change is applied on behalf of the proposer
+	_, err := c.insertScheduledChange(store.WithActor(ctx, cr.ProposedBy), tx, cr.CompanyID, m, effectiveAt)
+	return err
+}
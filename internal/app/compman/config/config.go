@@ -7,6 +7,7 @@ import (
 	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
 	"github.com/jmakaron/compman/internal/pkg/http"
 	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+	"github.com/jmakaron/compman/internal/pkg/tracing"
 )
 
 type AppConfig struct {
@@ -14,8 +15,50 @@ type AppConfig struct {
 	Db      postgres.PGConfig   `json:"db"`
 	Kp      kp.ProducerCfg      `json:"kp"`
 
+	Scheduler   SchedulerCfg   `json:"scheduler"`
+	Idempotency IdempotencyCfg `json:"idempotency"`
+	Jobs        JobsCfg        `json:"jobs"`
+	Tracing     tracing.Cfg    `json:"tracing"`
+	// ShutdownTimeoutMs bounds the wait for the requests in flight and the
+	// background workers on shutdown, they are cut off afterwards
+	ShutdownTimeoutMs int `json:"shutdown_timeout_ms"`
+
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// additional users, username to password, e.g. for approving change requests
+	Users map[string]string `json:"users"`
+	// roles of the users, set in their jwt token and required by the routes
+	// configured with roles
+	Roles map[string][]string `json:"roles"`
+}
+
+func (cfg *AppConfig) ValidCredentials(username, password string) bool {
+	if username == cfg.Username && password == cfg.Password {
+		return true
+	}
+	p, ok := cfg.Users[username]
+	return ok && p == password
+}
+
+// SchedulerCfg configures the scheduler applying effective-dated changes
+type SchedulerCfg struct {
+	IntervalMs int `json:"interval_ms"`
+	BatchSize  int `json:"batch_size"`
+}
+
+// IdempotencyCfg configures how long the responses of requests sent with an
+// Idempotency-Key are kept, and how often the expired ones are purged
+type IdempotencyCfg struct {
+	TTLSec           int `json:"ttl_sec"`
+	PurgeIntervalSec int `json:"purge_interval_sec"`
+}
+
+// JobsCfg configures the workers running jobs, jobs whose worker gave no
+// sign of life for lease_sec are run again
+type JobsCfg struct {
+	Workers        int `json:"workers"`
+	PollIntervalMs int `json:"poll_interval_ms"`
+	LeaseSec       int `json:"lease_sec"`
 }
 
 func ParseConfigFile(path string) (*AppConfig, error) {
@@ -0,0 +1,98 @@
+package compman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+)
+
+type duplicateClustersResp struct {
+	Threshold float64            `json:"threshold"`
+	Clusters  [][]*types.Company `json:"clusters"`
+	// Truncated is set if more companies than DuplicateClusterCandidates have
+	// a similar name, only the first ones are clustered
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// selectCompanies returns the companies matching filter, merged companies
+// are left out
+func (c *ServiceComponent) selectCompanies(ctx context.Context, filter map[string]interface{}) ([]*types.Company, error) {
+	e, err := c.st.NewEntity(&types.Company{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(filter); err != nil {
+		return nil, err
+	}
+	if err = e.Select(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	return i.([]*types.Company), nil
+}
+
+// findDuplicates returns the likely duplicates of a company named name among
+// the companies with the closest names selected through e
+func findDuplicates(ctx context.Context, e store.Entity, name string) ([]*types.DuplicateCandidate, error) {
+	if err := e.PrepareSelect(map[string]interface{}{types.FilterSimilarTo: name}); err != nil {
+		return nil, err
+	}
+	if err := e.Select(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	return types.FindDuplicates(name, i.([]*types.Company)), nil
+}
+
+// checkDuplicates fails with 409 and the likely duplicates of the company
+// to be inserted, if there are any
+func (c *ServiceComponent) checkDuplicates(ctx context.Context, company *types.Company) error {
+	e, err := c.st.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	candidates, err := findDuplicates(ctx, e, company.Name)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return httpsrv.NewError(http.StatusConflict,
+		fmt.Errorf("company '%s' has %d likely duplicates", company.Name, len(candidates))).
+		WithCode("likely_duplicate").
+		With("threshold", types.DuplicateThreshold).
+		With("candidates", candidates)
+}
+
+// companyDuplicatesHandler reports the clusters of companies with similar
+// names, only the companies with a similar name are compared
+func (c *ServiceComponent) companyDuplicatesHandler(w http.ResponseWriter, r *http.Request) error {
+	companies, err := c.selectCompanies(r.Context(), map[string]interface{}{types.FilterHasSimilar: true})
+	if err != nil {
+		return err
+	}
+	resp := duplicateClustersResp{Threshold: types.DuplicateThreshold, Clusters: types.DuplicateClusters(companies),
+		Truncated: len(companies) >= types.DuplicateClusterCandidates}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
@@ -7,68 +7,286 @@ import (
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/jmakaron/compman/internal/app/compman/store"
 	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
 	"github.com/jmakaron/compman/internal/app/compman/types"
 	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
 )
 
 const (
-	companyGet    = "company-get"
-	companyList   = "company-list"
-	companyInsert = "company-insert"
-	companyDelete = "company-delete"
-	companyUpdate = "company-update"
-	serviceLogin  = "login"
+	companyGet            = "company-get"
+	companyList           = "company-list"
+	companyInsert         = "company-insert"
+	companyDelete         = "company-delete"
+	companyUpdate         = "company-update"
+	companyStats          = "company-stats"
+	companyTransition     = "company-transition"
+	changeRequestList     = "change-request-list"
+	changeRequestApprove  = "change-request-approve"
+	changeRequestReject   = "change-request-reject"
+	companyDiff           = "company-diff"
+	scheduledChangeList   = "scheduled-change-list"
+	scheduledChangeCancel = "scheduled-change-cancel"
+	companyMerge          = "company-merge"
+	companyDuplicates     = "company-duplicates"
+	companyByIdentifier   = "company-by-identifier"
+	companyReplace        = "company-replace"
+	companyBatch          = "company-batch"
+	jobCreate             = "job-create"
+	jobList               = "job-list"
+	jobGet                = "job-get"
+	jobResult             = "job-result"
+	jobCancel             = "job-cancel"
+	serviceLogin          = "login"
 )
 
-func (c *ServiceComponent) getRestAPI() (httpsrv.RouteLayout, *httpsrv.RouterSpec) {
+// getRestAPI declares the routes of the service, the jobs and the mutating
+// company routes require a jwt token
+func (c *ServiceComponent) getRestAPI() *httpsrv.API {
 	rl := httpsrv.RouteLayout{
 		"/login": {
-			serviceLogin: {http.MethodPost, ""},
+			serviceLogin: {Method: http.MethodPost, Suffix: "", Doc: httpsrv.RouteDoc{
+				Summary:   "sets a jwt token in the Authorization header of the response",
+				Tags:      []string{"auth"},
+				Request:   loginReq{},
+				Responses: map[int]interface{}{http.StatusOK: nil},
+			}},
 		},
 		"/company": {
-			companyGet:    {http.MethodGet, "/{id1}"},
-			companyList:   {http.MethodGet, ""},
-			companyInsert: {http.MethodPost, ""},
-			companyDelete: {http.MethodDelete, "/{id1}"},
-			companyUpdate: {http.MethodPatch, "/{id1}"},
+			companyGet: {Method: http.MethodGet, Suffix: "/{id1}", Doc: httpsrv.RouteDoc{
+				Summary:   "returns the company",
+				Tags:      []string{"company"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Query:     []httpsrv.Param{asOfParam},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}},
+			}},
+			companyList: {Method: http.MethodGet, Suffix: "", Doc: httpsrv.RouteDoc{
+				Summary:   "lists the companies",
+				Tags:      []string{"company"},
+				Query:     companyQuery,
+				Responses: map[int]interface{}{http.StatusOK: []types.Company{}},
+			}},
+			companyInsert: {Method: http.MethodPost, Suffix: "", Doc: httpsrv.RouteDoc{
+				Summary:   "creates a company",
+				Tags:      []string{"company"},
+				Query:     []httpsrv.Param{forceParam},
+				Request:   types.Company{},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}},
+			}},
+			companyDelete: {Method: http.MethodDelete, Suffix: "/{id1}", Doc: httpsrv.RouteDoc{
+				Summary:   "proposes the deletion of the company",
+				Tags:      []string{"company"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Responses: map[int]interface{}{http.StatusAccepted: types.ChangeRequest{}},
+			}},
+			companyUpdate: {Method: http.MethodPatch, Suffix: "/{id1}", Doc: httpsrv.RouteDoc{
+				Summary: "updates the company, changes requiring approval are proposed as a change request and " +
+					"changes with a future effective_at are scheduled",
+				Tags: []string{"company"},
+				Path: []httpsrv.Param{companyIDParam},
+				MediaTypes: map[string]interface{}{
+					types.MediaTypeJSON:       types.Company{},
+					types.MediaTypeMergePatch: types.Company{},
+					types.MediaTypeJSONPatch:  []types.PatchOperation{},
+				},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}, http.StatusAccepted: types.ChangeRequest{}},
+			}},
+			companyStats: {Method: http.MethodGet, Suffix: "/stats", Doc: httpsrv.RouteDoc{
+				Summary:   "returns statistics of the companies",
+				Tags:      []string{"company"},
+				Query:     companyQuery,
+				Responses: map[int]interface{}{http.StatusOK: types.CompanyStats{}},
+			}},
+			companyTransition: {Method: http.MethodPost, Suffix: "/{id1}/transitions", Doc: httpsrv.RouteDoc{
+				Summary:   "moves the company to another lifecycle state",
+				Tags:      []string{"company"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Request:   transitionReq{},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}},
+			}},
+			changeRequestList: {Method: http.MethodGet, Suffix: "/{id1}/change-requests", Doc: httpsrv.RouteDoc{
+				Summary:   "lists the change requests of the company",
+				Tags:      []string{"change requests"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Query:     []httpsrv.Param{statusParam},
+				Responses: map[int]interface{}{http.StatusOK: []types.ChangeRequest{}},
+			}},
+			changeRequestApprove: {Method: http.MethodPost, Suffix: "/{id1}/change-requests/{id2}/approve", Doc: httpsrv.RouteDoc{
+				Summary:   "approves and applies the change request",
+				Tags:      []string{"change requests"},
+				Path:      []httpsrv.Param{companyIDParam, {Name: "id2", Description: "change request id"}},
+				Responses: map[int]interface{}{http.StatusOK: types.ChangeRequest{}},
+			}},
+			changeRequestReject: {Method: http.MethodPost, Suffix: "/{id1}/change-requests/{id2}/reject", Doc: httpsrv.RouteDoc{
+				Summary:   "rejects the change request",
+				Tags:      []string{"change requests"},
+				Path:      []httpsrv.Param{companyIDParam, {Name: "id2", Description: "change request id"}},
+				Responses: map[int]interface{}{http.StatusOK: types.ChangeRequest{}},
+			}},
+			companyDiff: {Method: http.MethodGet, Suffix: "/{id1}/diff", Doc: httpsrv.RouteDoc{
+				Summary: "compares the company at two points in time",
+				Tags:    []string{"company"},
+				Path:    []httpsrv.Param{companyIDParam},
+				Query: []httpsrv.Param{
+					{Name: "from", Required: true, Description: "RFC 3339 timestamp"},
+					{Name: "to", Description: "RFC 3339 timestamp, defaults to now"},
+				},
+				Responses: map[int]interface{}{http.StatusOK: types.CompanyDiff{}},
+			}},
+			scheduledChangeList: {Method: http.MethodGet, Suffix: "/{id1}/scheduled-changes", Doc: httpsrv.RouteDoc{
+				Summary:   "lists the scheduled changes of the company",
+				Tags:      []string{"scheduled changes"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Query:     []httpsrv.Param{statusParam},
+				Responses: map[int]interface{}{http.StatusOK: []types.ScheduledChange{}},
+			}},
+			scheduledChangeCancel: {Method: http.MethodDelete, Suffix: "/{id1}/scheduled-changes/{id2}", Doc: httpsrv.RouteDoc{
+				Summary:   "cancels the pending scheduled change",
+				Tags:      []string{"scheduled changes"},
+				Path:      []httpsrv.Param{companyIDParam, {Name: "id2", Description: "scheduled change id"}},
+				Responses: map[int]interface{}{http.StatusOK: types.ScheduledChange{}},
+			}},
+			companyMerge: {Method: http.MethodPost, Suffix: "/merge", Doc: httpsrv.RouteDoc{
+				Summary:   "merges duplicates into a survivor company",
+				Tags:      []string{"company"},
+				Request:   types.CompanyMerge{},
+				Responses: map[int]interface{}{http.StatusOK: types.CompanyMergeResult{}},
+			}},
+			companyDuplicates: {Method: http.MethodGet, Suffix: "/duplicates", Doc: httpsrv.RouteDoc{
+				Summary:   "returns the clusters of companies with similar names",
+				Tags:      []string{"company"},
+				Responses: map[int]interface{}{http.StatusOK: duplicateClustersResp{}},
+			}},
+			companyByIdentifier: {Method: http.MethodGet, Suffix: "/by-identifier/{id1}/{id2}", Doc: httpsrv.RouteDoc{
+				Summary: "returns the company with the legal identifier",
+				Tags:    []string{"company"},
+				Path: []httpsrv.Param{
+					{Name: "id1", Description: "lei, vat or registry"},
+					{Name: "id2", Description: "identifier, registry numbers are written <country>:<number>"},
+				},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}},
+			}},
+			companyReplace: {Method: http.MethodPut, Suffix: "/{id1}", Doc: httpsrv.RouteDoc{
+				Summary:   "creates or replaces the company",
+				Tags:      []string{"company"},
+				Path:      []httpsrv.Param{companyIDParam},
+				Query:     []httpsrv.Param{forceParam},
+				Request:   types.Company{},
+				Responses: map[int]interface{}{http.StatusOK: types.Company{}, http.StatusCreated: types.Company{}},
+			}},
+			companyBatch: {Method: http.MethodPost, Suffix: "/batch", Doc: httpsrv.RouteDoc{
+				Summary:   "applies create, patch and delete operations",
+				Tags:      []string{"company"},
+				Query:     []httpsrv.Param{forceParam},
+				Request:   types.CompanyBatch{},
+				Responses: map[int]interface{}{http.StatusOK: types.CompanyBatchResult{}},
+			}},
+		},
+		"/jobs": {
+			jobCreate: {Method: http.MethodPost, Suffix: "", Doc: httpsrv.RouteDoc{
+				Summary:   "queues an import, export or republish job",
+				Tags:      []string{"jobs"},
+				Request:   types.Job{},
+				Responses: map[int]interface{}{http.StatusAccepted: types.Job{}},
+			}},
+			jobList: {Method: http.MethodGet, Suffix: "", Doc: httpsrv.RouteDoc{
+				Summary: "lists the jobs, newest first",
+				Tags:    []string{"jobs"},
+				Query: []httpsrv.Param{
+					statusParam, {Name: types.FilterCreatedBy}, {Name: types.FilterLimit, Type: "integer"},
+				},
+				Responses: map[int]interface{}{http.StatusOK: []types.Job{}},
+			}},
+			jobGet: {Method: http.MethodGet, Suffix: "/{id1}", Doc: httpsrv.RouteDoc{
+				Summary:   "returns the job",
+				Tags:      []string{"jobs"},
+				Path:      []httpsrv.Param{{Name: "id1", Description: "job id"}},
+				Responses: map[int]interface{}{http.StatusOK: types.Job{}},
+			}},
+			jobResult: {Method: http.MethodGet, Suffix: "/{id1}/result", Doc: httpsrv.RouteDoc{
+				Summary:   "returns the result of the succeeded job",
+				Tags:      []string{"jobs"},
+				Path:      []httpsrv.Param{{Name: "id1", Description: "job id"}},
+				Responses: map[int]interface{}{http.StatusOK: json.RawMessage{}},
+			}},
+			jobCancel: {Method: http.MethodPost, Suffix: "/{id1}/cancel", Doc: httpsrv.RouteDoc{
+				Summary:   "cancels the queued or running job",
+				Tags:      []string{"jobs"},
+				Path:      []httpsrv.Param{{Name: "id1", Description: "job id"}},
+				Responses: map[int]interface{}{http.StatusOK: types.Job{}},
+			}},
 		}}
 	rs := httpsrv.RouterSpec{
-		serviceLogin:  c.serviceLogin,
-		companyGet:    c.companyGetHandler,
-		companyList:   c.companyListHandler,
-		companyInsert: httpsrv.JWTAuth(c.companyInsertHandler),
-		companyDelete: httpsrv.JWTAuth(c.companyDeleteHandler),
-		companyUpdate: httpsrv.JWTAuth(c.companyUpdateHandler),
-	}
-	return rl, &rs
+		serviceLogin:          c.serviceLogin,
+		companyGet:            c.companyGetHandler,
+		companyList:           c.companyListHandler,
+		companyInsert:         c.companyInsertHandler,
+		companyDelete:         c.companyDeleteHandler,
+		companyUpdate:         c.companyUpdateHandler,
+		companyStats:          c.companyStatsHandler,
+		companyTransition:     c.companyTransitionHandler,
+		changeRequestList:     c.changeRequestListHandler,
+		changeRequestApprove:  c.changeRequestApproveHandler,
+		changeRequestReject:   c.changeRequestRejectHandler,
+		companyDiff:           c.companyDiffHandler,
+		scheduledChangeList:   c.scheduledChangeListHandler,
+		scheduledChangeCancel: c.scheduledChangeCancelHandler,
+		companyMerge:          c.companyMergeHandler,
+		companyDuplicates:     c.companyDuplicatesHandler,
+		companyByIdentifier:   c.companyByIdentifierHandler,
+		companyReplace:        c.companyReplaceHandler,
+		companyBatch:          c.companyBatchHandler,
+		jobCreate:             c.jobCreateHandler,
+		jobList:               c.jobListHandler,
+		jobGet:                c.jobGetHandler,
+		jobResult:             c.jobResultHandler,
+		jobCancel:             c.jobCancelHandler,
+	}
+	mw := map[string][]httpsrv.Middleware{
+		"/jobs":               {httpsrv.JWTAuth},
+		companyInsert:         {httpsrv.JWTAuth, c.idempotent},
+		companyDelete:         {httpsrv.JWTAuth, c.idempotent},
+		companyUpdate:         {httpsrv.JWTAuth, c.idempotent},
+		companyTransition:     {httpsrv.JWTAuth, c.idempotent},
+		changeRequestApprove:  {httpsrv.JWTAuth, c.idempotent},
+		changeRequestReject:   {httpsrv.JWTAuth, c.idempotent},
+		scheduledChangeCancel: {httpsrv.JWTAuth, c.idempotent},
+		companyMerge:          {httpsrv.JWTAuth, c.idempotent},
+		companyReplace:        {httpsrv.JWTAuth, c.idempotent},
+		companyBatch:          {httpsrv.JWTAuth, c.idempotent},
+		jobCreate:             {c.idempotent},
+		jobCancel:             {c.idempotent},
+		changeRequestList:     {httpsrv.JWTAuth},
+		scheduledChangeList:   {httpsrv.JWTAuth},
+	}
+	return &httpsrv.API{Layout: rl, Spec: rs, Middleware: mw, Doc: apiDoc(), Checks: c.readinessChecks()}
+}
+
+type loginReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
 
+type transitionReq struct {
+	Transition string `json:"transition"`
 }
 
 func (c *ServiceComponent) serviceLogin(w http.ResponseWriter, r *http.Request) error {
-	type loginReq struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
-	}
 	var lr loginReq
-	err = json.Unmarshal(b, &lr)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := httpsrv.DecodeJSON(r, &lr); err != nil {
 		return err
 	}
-	if lr.Username != c.cfg.Username || lr.Password != c.cfg.Password {
-		w.WriteHeader(http.StatusForbidden)
-		return nil
+	if !c.cfg.ValidCredentials(lr.Username, lr.Password) {
+		return httpsrv.NewError(http.StatusForbidden, errors.New("invalid credentials"))
 	}
 	secretKey := []byte("MY_SECRET_key")
 	claims := jwt.MapClaims{
@@ -76,10 +294,12 @@ func (c *ServiceComponent) serviceLogin(w http.ResponseWriter, r *http.Request)
 		"user":       lr.Username,
 		"exp":        time.Now().Add(time.Hour * 24).Unix(),
 	}
+	if roles := c.cfg.Roles[lr.Username]; len(roles) > 0 {
+		claims["roles"] = roles
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString(secretKey)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 	w.Header().Set("Authorization", fmt.Sprintf("Bearer %s", tokenString))
@@ -90,7 +310,6 @@ func (c *ServiceComponent) serviceLogin(w http.ResponseWriter, r *http.Request)
 func (c *ServiceComponent) companyGetHandler(w http.ResponseWriter, r *http.Request) error {
 	e, err := c.st.NewEntity(&types.Company{})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 	defer func() {
@@ -100,35 +319,62 @@ func (c *ServiceComponent) companyGetHandler(w http.ResponseWriter, r *http.Requ
 	}()
 	id := httpsrv.GetIdList(r)[0]
 	if err := uuid.Validate(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return err
+		return httpsrv.NewError(http.StatusBadRequest, err)
 	}
 
-	if err := e.PrepareSelect(map[string]interface{}{
+	filter := map[string]interface{}{
 		"id": id,
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if v := r.URL.Query().Get(types.FilterAsOf); len(v) > 0 {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+		filter[types.FilterAsOf] = t
+	}
+	if err := e.PrepareSelect(filter); err != nil {
 		return err
 	}
-	if err := e.Select(context.Background()); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := e.Select(r.Context()); err != nil {
 		return err
 	}
 	var v interface{}
 	v, err = e.Value()
 	if err != nil {
-		if !errors.Is(err, postgres.ErrNotFound) {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-		}
-		return err
+		return httpError(err)
+	}
+	if len(v.([]*types.Company)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
 	}
 	rv := v.([]*types.Company)[0]
 
 	b, err := json.Marshal(rv)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// companyByIdentifierHandler returns the company with the legal identifier
+// of the scheme in the path
+func (c *ServiceComponent) companyByIdentifierHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := httpsrv.GetIdList(r)
+	filter, err := types.IdentifierFilter(vars[0], vars[1])
+	if err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	companies, err := c.selectCompanies(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+	if len(companies) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	b, err := json.Marshal(companies[0])
+	if err != nil {
 		return err
 	}
 	w.Header().Set("content-type", "application/json")
@@ -140,7 +386,6 @@ func (c *ServiceComponent) companyGetHandler(w http.ResponseWriter, r *http.Requ
 func (c *ServiceComponent) companyListHandler(w http.ResponseWriter, r *http.Request) error {
 	e, err := c.st.NewEntity(&types.Company{})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 	defer func() {
@@ -148,20 +393,21 @@ func (c *ServiceComponent) companyListHandler(w http.ResponseWriter, r *http.Req
 			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
 		}
 	}()
-	if err := e.PrepareSelect(map[string]interface{}{}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+	filter, err := parseCompanyFilter(r)
+	if err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	if err := e.PrepareSelect(filter); err != nil {
+		return httpError(err)
 	}
 	var rv []*types.Company
-	if err := e.Select(context.Background()); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := e.Select(r.Context()); err != nil {
 		return err
 	}
 	var i interface{}
 	i, err = e.Value()
 	if err != nil {
 		if !errors.Is(err, postgres.ErrNotFound) {
-			w.WriteHeader(http.StatusInternalServerError)
 			return err
 		}
 	} else {
@@ -172,7 +418,6 @@ func (c *ServiceComponent) companyListHandler(w http.ResponseWriter, r *http.Req
 	}
 	b, err := json.Marshal(rv)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 	w.Header().Set("content-type", "application/json")
@@ -181,73 +426,173 @@ func (c *ServiceComponent) companyListHandler(w http.ResponseWriter, r *http.Req
 	return nil
 }
 
-func (c *ServiceComponent) companyInsertHandler(w http.ResponseWriter, r *http.Request) error {
-	var company types.Company
-	b, err := io.ReadAll(r.Body)
+// parseCompanyFilter reads the list filter from the request query parameters
+func parseCompanyFilter(r *http.Request) (map[string]interface{}, error) {
+	return parseCompanyQuery(r.URL.Query())
+}
+
+// parseCompanyQuery reads the list filter from the query parameters q
+func parseCompanyQuery(q url.Values) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if v := q.Get(types.FilterName); len(v) > 0 {
+		m[types.FilterName] = v
+	}
+	if v := q.Get(types.FilterType); len(v) > 0 {
+		ctype := types.ParseCompanyType(v)
+		if ctype == -1 {
+			return nil, fmt.Errorf("invalid company type '%s'", v)
+		}
+		m[types.FilterType] = ctype
+	}
+	if v := q.Get(types.FilterState); len(v) > 0 {
+		state := types.ParseCompanyState(v)
+		if state == -1 {
+			return nil, fmt.Errorf("invalid company state '%s'", v)
+		}
+		m[types.FilterState] = state
+	}
+	if v := q.Get(types.FilterRegistered); len(v) > 0 {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		m[types.FilterRegistered] = b
+	}
+	for _, k := range []string{types.FilterMinEmployees, types.FilterMaxEmployees} {
+		if v := q.Get(k); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = n
+		}
+	}
+	for _, k := range []string{types.FilterCreatedSince, types.FilterUpdatedSince, types.FilterAsOf} {
+		if v := q.Get(k); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = t
+		}
+	}
+	for _, k := range []string{types.FilterCreatedBy, types.FilterUpdatedBy, types.FilterSort} {
+		if v := q.Get(k); len(v) > 0 {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+func (c *ServiceComponent) companyStatsHandler(w http.ResponseWriter, r *http.Request) error {
+	e, err := c.st.NewEntity(&types.Company{})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	defer r.Body.Close()
-	err = json.Unmarshal(b, &company)
+	defer func() {
+		for _, entry := range e.QueryLog() {
+			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
+		}
+	}()
+	filter, err := parseCompanyFilter(r)
+	if err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	var stats interface{}
+	if a, ok := e.(store.Aggregator); ok {
+		if err = a.PrepareAggregate(filter); err != nil {
+			return err
+		}
+		if stats, err = a.Aggregate(r.Context()); err != nil {
+			return err
+		}
+	} else {
+		if err = e.PrepareSelect(filter); err != nil {
+			return err
+		}
+		if err = e.Select(r.Context()); err != nil {
+			return err
+		}
+		var i interface{}
+		if i, err = e.Value(); err != nil && !errors.Is(err, postgres.ErrNotFound) {
+			return err
+		}
+		l, _ := i.([]*types.Company)
+		stats = types.AggregateCompanies(l)
+	}
+	b, err := json.Marshal(stats)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		return err
 	}
-	if len(company.Name) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// prepareNewCompany sets the fields of a company to be created that are not
+// taken from the client as is
+func prepareNewCompany(company *types.Company) {
+	// clients predating the lifecycle states create registered companies as active
+	if company.State == types.CompanyStateDraft && company.Registered {
+		company.State = types.CompanyStateActive
+	}
+	company.Registered = company.State.Registered()
+	company.ClearMetadata()
+}
+
+func (c *ServiceComponent) companyInsertHandler(w http.ResponseWriter, r *http.Request) error {
+	var company types.Company
+	err := httpsrv.DecodeJSON(r, &company)
+	if err != nil {
+		return err
 	}
-	if company.CType < types.CompanyTypeCorporation || company.CType > types.CompanyTypeSoleProprietorship {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+	if err = company.Validate(); err != nil {
+		return httpError(err)
 	}
 	company.ID = uuid.NewString()
-	b, err = json.Marshal(&company)
+	prepareNewCompany(&company)
+	if r.URL.Query().Get("force") != "true" {
+		if err := c.checkDuplicates(r.Context(), &company); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(&company)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	e, err := c.st.NewEntity(&company)
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	defer func() {
-		for _, entry := range e.QueryLog() {
-			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
-		}
-	}()
+	defer tx.Rollback(ctx)
+	e, err := tx.NewEntity(&company)
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
 	if err = e.PrepareInsert(b); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	if err = e.Insert(context.Background()); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err = e.Insert(ctx); err != nil {
+		return httpError(err)
+	}
+	i, err := e.Value()
+	if err != nil {
 		return err
 	}
-	var rollback bool
-	defer func(company *types.Company) {
-		if rollback {
-			if err := e.PrepareDelete(map[string]interface{}{"id": company.ID}); err != nil {
-				c.log.Error(fmt.Sprintf("failed to rollback insert operation, %+v", err))
-				return
-			}
-			if err := e.Delete(context.Background()); err != nil {
-				c.log.Error(fmt.Sprintf("failed to rollback insert operation, %+v", err))
-				return
-			}
-		}
-	}(&company)
+	company = *i.([]*types.Company)[0]
 	evt, err := types.NewKafkaCompanyEvent(&company, "insert")
 	if err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	if err := c.kp.PublishWithRetry(evt); err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	c.publishCommitted(ctx, evt)
+	b, err = json.Marshal(&company)
+	if err != nil {
 		return err
 	}
 	w.Header().Set("content-type", "application/json")
@@ -256,186 +601,328 @@ func (c *ServiceComponent) companyInsertHandler(w http.ResponseWriter, r *http.R
 	return nil
 }
 
+// companyDeleteHandler proposes the deletion, which is applied once approved
+// by a second user
 func (c *ServiceComponent) companyDeleteHandler(w http.ResponseWriter, r *http.Request) error {
 	id := httpsrv.GetIdList(r)[0]
 	if err := uuid.Validate(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	return c.proposeChange(w, r, id, types.ChangeKindDelete, nil)
+}
+
+// httpError returns err as the typed error of its status, the errors of the
+// store and of company documents are client errors, others are answered with 500
+func httpError(err error) error {
+	var he *httpsrv.Error
+	var ve *types.ValidationError
+	switch {
+	case errors.As(err, &he):
+		return err
+	case errors.As(err, &ve):
+		fields := make([]httpsrv.FieldError, len(ve.Fields))
+		for i, f := range ve.Fields {
+			fields[i] = httpsrv.FieldError{Field: f.Field, Message: f.Message}
+		}
+		return httpsrv.NewError(http.StatusBadRequest, err).WithCode("invalid_fields").WithFields(fields...)
+	case errors.Is(err, types.ErrInvalidPatch), errors.Is(err, types.ErrInvalidIdentifier),
+		errors.Is(err, postgres.ErrInvalidArg), errors.Is(err, postgres.ErrMissingArg),
+		errors.Is(err, errInvalidChange):
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	case errors.Is(err, postgres.ErrNotFound):
+		return httpsrv.NewError(http.StatusNotFound, err)
+	case errors.Is(err, postgres.ErrDuplicate):
+		return httpsrv.NewError(http.StatusConflict, err).WithCode("duplicate")
+	case errors.Is(err, types.ErrPatchConflict):
+		return httpsrv.NewError(http.StatusConflict, err)
+	case errors.Is(err, errUnsupportedMediaType):
+		return httpsrv.NewError(http.StatusUnsupportedMediaType, err)
+	}
+	return err
+}
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// applyPatch applies the update document b of the media type to the company
+// document doc, returning the changed fields and the time at which they
+// take effect. Merge patches may hold the effective_at member, plain JSON
+// documents are handled as merge patches.
+func applyPatch(mediaType string, b []byte, doc map[string]interface{}) (map[string]interface{}, time.Time, error) {
+	var effectiveAt time.Time
+	var patched interface{}
+	switch mediaType {
+	case "", types.MediaTypeJSON, types.MediaTypeMergePatch:
+		var patch interface{}
+		if err := httpsrv.UnmarshalJSON(b, &patch); err != nil {
+			return nil, effectiveAt, fmt.Errorf("%w, %v", types.ErrInvalidPatch, err)
+		}
+		if m, ok := patch.(map[string]interface{}); ok {
+			var err error
+			if effectiveAt, err = types.PopEffectiveAt(m); err != nil {
+				return nil, effectiveAt, fmt.Errorf("%w, %v", types.ErrInvalidPatch, err)
+			}
+		}
+		patched = types.MergePatch(doc, patch)
+	case types.MediaTypeJSONPatch:
+		var ops []types.PatchOperation
+		if err := httpsrv.UnmarshalJSON(b, &ops); err != nil {
+			return nil, effectiveAt, fmt.Errorf("%w, %v", types.ErrInvalidPatch, err)
+		}
+		var err error
+		if patched, err = types.ApplyJSONPatch(doc, ops); err != nil {
+			return nil, effectiveAt, err
+		}
+	default:
+		return nil, effectiveAt, fmt.Errorf("%w '%s'", errUnsupportedMediaType, mediaType)
+	}
+	to, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, effectiveAt, fmt.Errorf("%w, the patched company is not a JSON object", types.ErrInvalidPatch)
+	}
+	return to, effectiveAt, nil
+}
+
+// updateCompany applies the changes m, holding the id of the company, to the
+// company locked through e. It returns the updated company and its update
+// event to publish once committed, or the company and no event if m holds
+// nothing but the id.
+func updateCompany(ctx context.Context, e store.Entity, company *types.Company,
+	m map[string]interface{}) (*types.Company, kp.KEvent, error) {
+	if len(m) == 1 {
+		return company, nil, nil
+	}
+	if err := e.PrepareUpdate(m); err != nil {
+		return nil, nil, err
+	}
+	if err := e.Update(ctx); err != nil {
+		return nil, nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, nil, err
+	}
+	company = i.([]*types.Company)[0]
+	evt, err := types.NewKafkaCompanyEvent(company, "update")
+	if err != nil {
+		return nil, nil, err
+	}
+	return company, evt, nil
+}
+
+// companyUpdateHandler patches the company with a JSON Merge Patch (RFC 7396)
+// or a JSON Patch (RFC 6902), selected by the Content-Type header. The patch
+// applies to the current company, locked until the update is committed.
+func (c *ServiceComponent) companyUpdateHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil && len(r.Header.Get("content-type")) > 0 {
+		return httpsrv.NewError(http.StatusUnsupportedMediaType, err)
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
 		return err
 	}
-	e, err := c.st.NewEntity(&types.Company{})
+	r.Body.Close()
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	defer func() {
-		for _, entry := range e.QueryLog() {
-			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
-		}
-	}()
-	if err = e.PrepareDelete(map[string]interface{}{"id": id}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	defer tx.Rollback(ctx)
+	e, err := tx.NewEntity(&types.Company{})
+	if err != nil {
 		return err
 	}
-	if err = e.Delete(context.Background()); err != nil {
-		if errors.Is(err, postgres.ErrNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: id, types.FilterLock: true}); err != nil {
+		return err
+	}
+	if err = e.Select(ctx); err != nil {
 		return err
 	}
-	var rollback bool
 	i, err := e.Value()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
+	if len(i.([]*types.Company)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
 	company := i.([]*types.Company)[0]
-	defer func(company *types.Company) {
-		if rollback {
-			b, _ := json.Marshal(company)
-			if err := e.PrepareInsert(b); err != nil {
-				c.log.Error(fmt.Sprintf("failed to rollback delete operation, %+v", err))
-				return
-			}
-			if err = e.Insert(context.Background()); err != nil {
-				c.log.Error(fmt.Sprintf("failed to rollback delete operation, %+v", err))
-				return
+	from, err := types.CompanyDocument(company)
+	if err != nil {
+		return err
+	}
+	// doc is patched in place, the changes are found against the copy from
+	doc, err := types.CompanyDocument(company)
+	if err != nil {
+		return err
+	}
+	to, effectiveAt, err := applyPatch(mediaType, b, doc)
+	if err != nil {
+		return httpError(err)
+	}
+	m := types.PatchChanges(from, to)
+	if err = types.NormalizePatch(company, m); err != nil {
+		return httpError(err)
+	}
+	scheduled := effectiveAt.After(time.Now())
+	if types.RequiresApproval(types.ChangeKindUpdate, m) || scheduled {
+		// the lock is released, proposals and scheduled changes apply later
+		tx.Rollback(ctx)
+		if types.RequiresApproval(types.ChangeKindUpdate, m) {
+			// the change is scheduled once approved
+			if scheduled {
+				m[types.EffectiveAtKey] = effectiveAt
 			}
+			return c.proposeChange(w, r, id, types.ChangeKindUpdate, m)
 		}
-	}(company)
-	evt, err := types.NewKafkaCompanyEvent(company, "delete")
+		return c.scheduleChange(w, r, id, m, effectiveAt)
+	}
+	company, evt, err := updateCompany(ctx, e, company, m)
 	if err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
+		return httpError(err)
 	}
-	if err := c.kp.PublishWithRetry(evt); err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
+	if evt != nil {
+		if err = tx.Commit(ctx); err != nil {
+			return err
+		}
+		c.publishCommitted(ctx, evt)
+	}
+	b, err = json.Marshal(company)
+	if err != nil {
 		return err
 	}
+	w.Header().Set("content-type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(b)
 	return nil
 }
 
-func (c *ServiceComponent) companyUpdateHandler(w http.ResponseWriter, r *http.Request) error {
+func (c *ServiceComponent) companyTransitionHandler(w http.ResponseWriter, r *http.Request) error {
 	id := httpsrv.GetIdList(r)[0]
 	if err := uuid.Validate(id); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	var tr transitionReq
+	err := httpsrv.DecodeJSON(r, &tr)
+	if err != nil {
 		return err
 	}
-	b, err := io.ReadAll(r.Body)
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	// the company is locked until the transition is committed, so that
+	// concurrent transitions apply one after the other
+	tx, err := c.st.Begin(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	r.Body.Close()
-	m := map[string]interface{}{}
-	if err = json.Unmarshal(b, &m); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	defer tx.Rollback(ctx)
+	e, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: id, types.FilterLock: true}); err != nil {
+		return err
+	}
+	if err = e.Select(ctx); err != nil {
 		return err
 	}
-	{
-		if id2, ok := m[id]; ok && id != id2 {
-			w.WriteHeader(http.StatusBadRequest)
-			return nil
-		} else if !ok {
-			m["id"] = id
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	l := i.([]*types.Company)
+	if len(l) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	from := l[0].State
+	to, err := from.Apply(tr.Transition)
+	if err != nil {
+		err = fmt.Errorf("%w '%s' from state '%s'", err, tr.Transition, from)
+		if errors.Is(err, types.ErrInvalidTransition) {
+			return httpsrv.NewError(http.StatusConflict, err)
 		}
-		if v, ok := m["type"]; ok {
-			ctype := types.ParseCompanyType(v.(string))
-			if ctype == -1 {
-				w.WriteHeader(http.StatusBadRequest)
-				return nil
-			}
-			m["type"] = ctype
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	if err = e.PrepareUpdate(map[string]interface{}{types.FilterID: id, "state": to}); err != nil {
+		return err
+	}
+	if err = e.Update(ctx); err != nil {
+		return httpError(err)
+	}
+	if i, err = e.Value(); err != nil {
+		return err
+	}
+	company := i.([]*types.Company)[0]
+	evt, err := types.NewKafkaCompanyEvent(company, tr.Transition)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	c.publishCommitted(ctx, evt)
+	b, err := json.Marshal(company)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// companyDiffHandler compares the company at the points in time given by the
+// "from" and "to" (defaults to now) query parameters
+func (c *ServiceComponent) companyDiffHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	q := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, q.Get("from"))
+	if err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	to := time.Now()
+	if v := q.Get("to"); len(v) > 0 {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
 		}
 	}
 	e, err := c.st.NewEntity(&types.Company{})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	defer func() {
-		for _, entry := range e.QueryLog() {
-			c.log.Debug(fmt.Sprintf("[DB]: %s %+v", entry.End.Sub(entry.Start), entry))
-		}
-	}()
-	var rollback bool
-	{
-		if err := e.PrepareSelect(map[string]interface{}{"id": id}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+	defer c.logQueries(e)
+	var states [2]*types.Company
+	for idx, t := range []time.Time{from, to} {
+		if err = e.PrepareSelect(map[string]interface{}{types.FilterID: id, types.FilterAsOf: t}); err != nil {
 			return err
 		}
-		if err := e.Select(context.Background()); err != nil {
-			if errors.Is(err, postgres.ErrNotFound) {
-				w.WriteHeader(http.StatusNotFound)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+		if err = e.Select(r.Context()); err != nil {
 			return err
 		}
 		i, err := e.Value()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			return err
 		}
-		defer func(company *types.Company) {
-			if rollback {
-				m := map[string]interface{}{}
-				b, _ := json.Marshal(company)
-				json.Unmarshal(b, &m)
-				m["type"] = company.CType
-				if err = e.PrepareUpdate(m); err != nil {
-					c.log.Error(fmt.Sprintf("failed to rollback update operation, %+v", err))
-					return
-				}
-				if err = e.Update(context.Background()); err != nil {
-					c.log.Error(fmt.Sprintf("failed to rollback update operation, %+v", err))
-					return
-				}
-			}
-		}(i.([]*types.Company)[0])
-	}
-	if err = e.PrepareUpdate(m); err != nil {
-		if errors.Is(err, postgres.ErrInvalidArg) ||
-			errors.Is(err, postgres.ErrMissingArg) {
-			w.WriteHeader(http.StatusBadRequest)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		if l := i.([]*types.Company); len(l) > 0 {
+			states[idx] = l[0]
 		}
-		return err
 	}
-	if err = e.Update(context.Background()); err != nil {
-		if errors.Is(err, postgres.ErrNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		return err
+	if states[0] == nil && states[1] == nil {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
 	}
-
-	i, err := e.Value()
+	diff, err := types.DiffCompanies(states[0], states[1])
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	company := i.([]*types.Company)[0]
-	evt, err := types.NewKafkaCompanyEvent(company, "update")
-	if err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
-	}
-	if err := c.kp.PublishWithRetry(evt); err != nil {
-		rollback = true
-		w.WriteHeader(http.StatusInternalServerError)
-		return err
-	}
-	b, err = json.Marshal(company)
+	b, err := json.Marshal(diff)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
 	w.Header().Set("content-type", "application/json")
@@ -0,0 +1,134 @@
+package compman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+)
+
+// workerGrace is added to the interval of a worker before it is reported as
+// stuck, e.g. for slow queries
+const workerGrace = 30 * time.Second
+
+var errWorkersNotStarted = errors.New("background workers not started")
+
+type ctxKey int
+
+// workerKey holds the name of the worker running a job, in the context of the
+// job
+const workerKey ctxKey = iota
+
+type heartbeat struct {
+	at time.Time
+	// every is the longest expected gap between two beats
+	every time.Duration
+	// busy workers run a job, every is its lease renewed by its progress
+	busy bool
+}
+
+// workerHealth holds the last heartbeat of each background worker
+type workerHealth struct {
+	mu    sync.Mutex
+	beats map[string]heartbeat
+}
+
+// beat records that worker name is alive, and beats again within every
+func (wh *workerHealth) beat(name string, every time.Duration) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.beats == nil {
+		wh.beats = map[string]heartbeat{}
+	}
+	wh.beats[name] = heartbeat{at: time.Now(), every: every}
+}
+
+// busy records that worker name runs a job, the job must make progress
+// within lease. It returns the context of the job run by the worker.
+func (wh *workerHealth) busy(ctx context.Context, name string, lease time.Duration) context.Context {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.beats == nil {
+		wh.beats = map[string]heartbeat{}
+	}
+	wh.beats[name] = heartbeat{at: time.Now(), every: lease, busy: true}
+	return context.WithValue(ctx, workerKey, name)
+}
+
+// progress renews the lease of the busy worker running the job of ctx
+func (wh *workerHealth) progress(ctx context.Context) {
+	name, ok := ctx.Value(workerKey).(string)
+	if !ok {
+		return
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if hb, ok := wh.beats[name]; ok && hb.busy {
+		hb.at = time.Now()
+		wh.beats[name] = hb
+	}
+}
+
+// exit forgets worker name, once returned
+func (wh *workerHealth) exit(name string) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	delete(wh.beats, name)
+}
+
+// running returns the names of the workers not returned yet
+func (wh *workerHealth) running() []string {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	l := make([]string, 0, len(wh.beats))
+	for name := range wh.beats {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// check fails if no worker started or if some did not beat in time, busy
+// workers fail once their job makes no progress within its lease
+func (wh *workerHealth) check(context.Context) error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if len(wh.beats) == 0 {
+		return errWorkersNotStarted
+	}
+	stuck := []string{}
+	for name, hb := range wh.beats {
+		since := time.Since(hb.at)
+		switch {
+		case since <= hb.every+workerGrace:
+		case hb.busy:
+			stuck = append(stuck, fmt.Sprintf("%s (job without progress for %s)", name, since.Round(time.Second)))
+		default:
+			stuck = append(stuck, fmt.Sprintf("%s (last beat %s ago)", name, since.Round(time.Second)))
+		}
+	}
+	if len(stuck) > 0 {
+		sort.Strings(stuck)
+		return fmt.Errorf("stuck background workers: %s", strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+// readinessChecks returns the checks of the readiness probe: the store, the
+// kafka producer and the background workers
+func (c *ServiceComponent) readinessChecks() map[string]httpsrv.Check {
+	checks := map[string]httpsrv.Check{
+		"kafka":   c.kp.Ping,
+		"workers": c.health.check,
+	}
+	if p, ok := c.st.(store.Pinger); ok {
+		checks["postgres"] = p.Ping
+	}
+	return checks
+}
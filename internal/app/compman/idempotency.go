@@ -0,0 +1,123 @@
+package compman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+)
+
+const (
+	defaultIdempotencyTTL   = 24 * time.Hour
+	defaultIdempotencyPurge = time.Hour
+)
+
+// idempotencyStore keeps the responses of the Idempotency-Key requests in the
+// idempotency_keys table
+type idempotencyStore struct {
+	st  store.Store
+	ttl time.Duration
+}
+
+func (c *ServiceComponent) newIdempotencyStore() *idempotencyStore {
+	ttl := time.Duration(c.cfg.Idempotency.TTLSec) * time.Second
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return &idempotencyStore{st: c.st, ttl: ttl}
+}
+
+func (s *idempotencyStore) Reserve(ctx context.Context, key string, fingerprint string) (*httpsrv.StoredResponse, error) {
+	e, err := s.st.NewEntity(&types.IdempotencyRecord{})
+	if err != nil {
+		return nil, err
+	}
+	rec := &types.IdempotencyRecord{Key: key, Fingerprint: fingerprint, ExpiresAt: time.Now().Add(s.ttl)}
+	if err = e.PrepareInsert(rec); err != nil {
+		return nil, err
+	}
+	if err = e.Insert(ctx); !errors.Is(err, postgres.ErrDuplicate) {
+		return nil, err
+	}
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: key}); err != nil {
+		return nil, err
+	}
+	if err = e.Select(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	l := i.([]*types.IdempotencyRecord)
+	if len(l) == 0 {
+		// released in the meantime
+		return nil, fmt.Errorf("%w, released while reserved", httpsrv.ErrKeyInUse)
+	}
+	return &httpsrv.StoredResponse{Fingerprint: l[0].Fingerprint, Status: l[0].Status,
+		ContentType: l[0].ContentType, Body: l[0].Body}, httpsrv.ErrKeyInUse
+}
+
+func (s *idempotencyStore) Save(ctx context.Context, key string, resp *httpsrv.StoredResponse) error {
+	e, err := s.st.NewEntity(&types.IdempotencyRecord{})
+	if err != nil {
+		return err
+	}
+	if err = e.PrepareUpdate(&types.IdempotencyRecord{Key: key, Fingerprint: resp.Fingerprint,
+		Status: resp.Status, ContentType: resp.ContentType, Body: resp.Body}); err != nil {
+		return err
+	}
+	return e.Update(ctx)
+}
+
+func (s *idempotencyStore) Release(ctx context.Context, key string) error {
+	e, err := s.st.NewEntity(&types.IdempotencyRecord{})
+	if err != nil {
+		return err
+	}
+	if err = e.PrepareDelete(map[string]interface{}{"id": key}); err != nil {
+		return err
+	}
+	return e.Delete(ctx)
+}
+
+// idempotent replays the responses of requests repeating an Idempotency-Key,
+// it goes after JWTAuth
+func (c *ServiceComponent) idempotent(handler httpsrv.HandlerWithError) httpsrv.HandlerWithError {
+	return httpsrv.Idempotent(c.idem, handler)
+}
+
+// runIdempotencyPurge drops the expired idempotency keys every interval,
+// until ctx is done
+func (c *ServiceComponent) runIdempotencyPurge(ctx context.Context) {
+	defer c.workers.Done()
+	defer c.health.exit("idempotency purge")
+	interval := time.Duration(c.cfg.Idempotency.PurgeIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultIdempotencyPurge
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.health.beat("idempotency purge", interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		e, err := c.st.NewEntity(&types.IdempotencyRecord{})
+		if err == nil {
+			if err = e.PrepareDelete(map[string]interface{}{types.FilterDue: time.Now()}); err == nil {
+				err = e.Delete(ctx)
+			}
+		}
+		if err != nil {
+			c.log.Error(fmt.Sprintf("failed to purge expired idempotency keys, %+v", err))
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package compman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+)
+
+const (
+	defaultJobWorkers      = 2
+	defaultJobPollInterval = time.Second
+	defaultJobLease        = 5 * time.Minute
+	defaultJobListLimit    = 100
+	// jobProgressEvery is the number of companies handled between two
+	// progress updates, jobs notice their cancellation on progress updates
+	jobProgressEvery = 50
+)
+
+// errJobCancelled stops a job that is no longer running, cancelled or run
+// again by another worker
+var errJobCancelled = errors.New("job cancelled")
+
+// jobView sets the location of the result of succeeded jobs
+func (c *ServiceComponent) jobView(j *types.Job) *types.Job {
+	if j.Status == types.JobSucceeded && len(j.Result) > 0 {
+		j.ResultLocation = fmt.Sprintf("/%s/jobs/%s/result", c.cfg.HttpCfg.SrvPrefix, j.ID)
+	}
+	return j
+}
+
+func (c *ServiceComponent) selectJob(ctx context.Context, id string) (*types.Job, error) {
+	e, err := c.st.NewEntity(&types.Job{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: id}); err != nil {
+		return nil, err
+	}
+	if err = e.Select(ctx); err != nil {
+		return nil, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return nil, err
+	}
+	if len(i.([]*types.Job)) == 0 {
+		return nil, postgres.ErrNotFound
+	}
+	return i.([]*types.Job)[0], nil
+}
+
+// updateJob applies the update m to the running job j, failing with
+// errJobCancelled if it is no longer running or was claimed again by another
+// worker
+func (c *ServiceComponent) updateJob(ctx context.Context, j *types.Job, m map[string]interface{}) error {
+	e, err := c.st.NewEntity(&types.Job{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	m["id"] = j.ID
+	m[postgres.JobFrom] = []types.JobStatus{types.JobRunning}
+	m[postgres.JobClaim] = j.Claim
+	if err = e.PrepareUpdate(m); err != nil {
+		return err
+	}
+	if err = e.Update(ctx); errors.Is(err, postgres.ErrNotFound) {
+		return errJobCancelled
+	}
+	if err == nil {
+		// the lease of the job is renewed by the update
+		c.health.progress(ctx)
+	}
+	return err
+}
+
+// jobProgress records the progress of the running job j, along with the
+// partial result jobs resume from if they are run again
+func (c *ServiceComponent) jobProgress(ctx context.Context, j *types.Job, done, total int, partial interface{}) error {
+	m := map[string]interface{}{"progress_done": done, "progress_total": total}
+	if partial != nil {
+		b, err := json.Marshal(partial)
+		if err != nil {
+			return err
+		}
+		m["result"] = b
+	}
+	return c.updateJob(ctx, j, m)
+}
+
+// jobCreateHandler queues the job of the request body, answering with 202
+// and the job, whose location is in the Location header
+func (c *ServiceComponent) jobCreateHandler(w http.ResponseWriter, r *http.Request) error {
+	var j types.Job
+	err := httpsrv.DecodeJSON(r, &j)
+	if err != nil {
+		return err
+	}
+	if err = j.Validate(); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	if len(j.Params.Query) > 0 {
+		q, err := url.ParseQuery(j.Params.Query)
+		if err == nil {
+			_, err = parseCompanyQuery(q)
+		}
+		if err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+	}
+	j.ID = uuid.NewString()
+	j.Progress = types.JobProgress{Total: len(j.Params.Companies)}
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	e, err := c.st.NewEntity(&j)
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareInsert(&j); err != nil {
+		return err
+	}
+	if err = e.Insert(ctx); err != nil {
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	rv := i.([]*types.Job)[0]
+	b, err := json.Marshal(c.jobView(rv))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("location", fmt.Sprintf("/%s/jobs/%s", c.cfg.HttpCfg.SrvPrefix, rv.ID))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+	return nil
+}
+
+// jobListHandler lists the jobs newest first, filtered by the status and
+// created_by query parameters
+func (c *ServiceComponent) jobListHandler(w http.ResponseWriter, r *http.Request) error {
+	filter := map[string]interface{}{types.FilterLimit: defaultJobListLimit}
+	q := r.URL.Query()
+	if v := q.Get(types.FilterStatus); len(v) > 0 {
+		status := types.ParseJobStatus(v)
+		if status == -1 {
+			return httpsrv.NewError(http.StatusBadRequest, fmt.Errorf("invalid job status '%s'", v))
+		}
+		filter[types.FilterStatus] = status
+	}
+	if v := q.Get(types.FilterCreatedBy); len(v) > 0 {
+		filter[types.FilterCreatedBy] = v
+	}
+	if v := q.Get(types.FilterLimit); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return httpsrv.NewError(http.StatusBadRequest, fmt.Errorf("invalid limit '%s'", v))
+		}
+		filter[types.FilterLimit] = n
+	}
+	e, err := c.st.NewEntity(&types.Job{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(filter); err != nil {
+		return err
+	}
+	if err = e.Select(r.Context()); err != nil {
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	rv := i.([]*types.Job)
+	for _, j := range rv {
+		c.jobView(j)
+	}
+	b, err := json.Marshal(rv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+func (c *ServiceComponent) jobGetHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	j, err := c.selectJob(r.Context(), id)
+	if err != nil {
+		return httpError(err)
+	}
+	b, err := json.Marshal(c.jobView(j))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// jobResultHandler returns the result of a succeeded job, 409 until the job succeeds
+func (c *ServiceComponent) jobResultHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	j, err := c.selectJob(r.Context(), id)
+	if err != nil {
+		return httpError(err)
+	}
+	if j.Status != types.JobSucceeded {
+		return httpsrv.NewError(http.StatusConflict, fmt.Errorf("job %s is %s", id, j.Status))
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j.Result)
+	return nil
+}
+
+// jobCancelHandler cancels a queued or running job, running jobs stop at
+// their next progress update. Finished jobs get 409.
+func (c *ServiceComponent) jobCancelHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	ctx := r.Context()
+	e, err := c.st.NewEntity(&types.Job{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareUpdate(map[string]interface{}{"id": id, "status": types.JobCancelled,
+		postgres.JobFrom: []types.JobStatus{types.JobQueued, types.JobRunning}}); err != nil {
+		return err
+	}
+	if err = e.Update(ctx); err != nil {
+		if !errors.Is(err, postgres.ErrNotFound) {
+			return err
+		}
+		// either missing or already finished
+		j, err := c.selectJob(ctx, id)
+		if err != nil {
+			return httpError(err)
+		}
+		return httpsrv.NewError(http.StatusConflict, fmt.Errorf("job %s is already %s", id, j.Status))
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c.jobView(i.([]*types.Job)[0]))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// startJobWorkers starts the pool of workers running the queued jobs until
+// ctx is done, jobs in flight then run to their end
+func (c *ServiceComponent) startJobWorkers(ctx context.Context) {
+	n := c.cfg.Jobs.Workers
+	if n <= 0 {
+		n = defaultJobWorkers
+	}
+	c.workers.Add(n)
+	for i := 0; i < n; i++ {
+		go c.runJobWorker(ctx, fmt.Sprintf("job worker %d", i))
+	}
+}
+
+func (c *ServiceComponent) runJobWorker(ctx context.Context, name string) {
+	defer c.workers.Done()
+	defer c.health.exit(name)
+	interval := time.Duration(c.cfg.Jobs.PollIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultJobPollInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for ctx.Err() == nil {
+			ran, err := c.runNextJob(name)
+			c.health.beat(name, interval)
+			if err != nil {
+				c.log.Error(fmt.Sprintf("job worker failed, %+v", err))
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runNextJob claims the next job and runs it by worker name, reporting false
+// if there was none to run
+func (c *ServiceComponent) runNextJob(name string) (bool, error) {
+	lease := time.Duration(c.cfg.Jobs.LeaseSec) * time.Second
+	if lease <= 0 {
+		lease = defaultJobLease
+	}
+	wctx := c.health.busy(c.ctx, name, lease)
+	e, err := c.st.NewEntity(&types.Job{})
+	if err != nil {
+		return false, err
+	}
+	defer c.logQueries(e)
+	claimer, ok := e.(store.Claimer)
+	if !ok {
+		return false, errors.New("store does not support claiming jobs")
+	}
+	if err = claimer.PrepareClaim(lease); err != nil {
+		return false, err
+	}
+	if err = claimer.Claim(wctx); err != nil {
+		if errors.Is(err, postgres.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return false, err
+	}
+	j := i.([]*types.Job)[0]
+	c.log.Debug(fmt.Sprintf("running %s job %s of %s", j.Kind, j.ID, j.CreatedBy))
+	// jobs run on behalf of the user creating them
+	ctx := store.WithActor(wctx, j.CreatedBy)
+	var result interface{}
+	switch j.Kind {
+	case types.JobImport:
+		result, err = c.runImportJob(ctx, j)
+	case types.JobExport:
+		result, err = c.runExportJob(ctx, j)
+	case types.JobRepublish:
+		result, err = c.runRepublishJob(ctx, j)
+	default:
+		err = fmt.Errorf("unknown job kind '%s'", j.Kind)
+	}
+	m := map[string]interface{}{}
+	switch {
+	case errors.Is(err, errJobCancelled):
+		c.log.Debug(fmt.Sprintf("job %s cancelled", j.ID))
+		return true, nil
+	case err != nil:
+		m["status"] = types.JobFailed
+		m["error"] = err.Error()
+	default:
+		b, err := json.Marshal(result)
+		if err != nil {
+			return true, err
+		}
+		m["status"] = types.JobSucceeded
+		m["result"] = b
+	}
+	if err = c.updateJob(ctx, j, m); errors.Is(err, errJobCancelled) {
+		err = nil
+	}
+	return true, err
+}
+
+// runImportJob creates the companies of the job as POST does, resuming after
+// the companies handled by an earlier run
+func (c *ServiceComponent) runImportJob(ctx context.Context, j *types.Job) (interface{}, error) {
+	res := types.JobImportResult{Results: []*types.BatchResult{}}
+	if len(j.Result) > 0 {
+		if err := json.Unmarshal(j.Result, &res); err != nil {
+			return nil, err
+		}
+	}
+	run := &batchRun{force: j.Params.Force}
+	total := len(j.Params.Companies)
+	for n := len(res.Results); n < total; n++ {
+		o := types.BatchOperation{Op: types.BatchCreate, Company: j.Params.Companies[n]}
+		r := c.runBatchOperation(ctx, run, &o)
+		if len(r.Error) > 0 {
+			res.Failed++
+		} else {
+			res.Created++
+		}
+		res.Results = append(res.Results, r)
+		if (n+1)%jobProgressEvery == 0 || n+1 == total {
+			if err := c.jobProgress(ctx, j, n+1, total, &res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &res, nil
+}
+
+func (c *ServiceComponent) selectJobCompanies(ctx context.Context, j *types.Job) ([]*types.Company, error) {
+	q, err := url.ParseQuery(j.Params.Query)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseCompanyQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return c.selectCompanies(ctx, filter)
+}
+
+// runExportJob returns the companies matching the query of the job
+func (c *ServiceComponent) runExportJob(ctx context.Context, j *types.Job) (interface{}, error) {
+	companies, err := c.selectJobCompanies(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.jobProgress(ctx, j, len(companies), len(companies), nil); err != nil {
+		return nil, err
+	}
+	return companies, nil
+}
+
+// runRepublishJob publishes the current state of the companies matching the
+// query of the job, consumers may get some of them twice if the job is run again
+func (c *ServiceComponent) runRepublishJob(ctx context.Context, j *types.Job) (interface{}, error) {
+	companies, err := c.selectJobCompanies(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	res := types.JobRepublishResult{}
+	for n := 0; n < len(companies); n += jobProgressEvery {
+		chunk := companies[n:min(n+jobProgressEvery, len(companies))]
+		evts := make([]kp.KEvent, len(chunk))
+		for i, company := range chunk {
+			if evts[i], err = types.NewKafkaCompanyEvent(company, types.OpRepublish); err != nil {
+				return nil, err
+			}
+		}
+		if err = c.kp.PublishWithRetry(ctx, evts...); err != nil {
+			return nil, err
+		}
+		res.Published += len(chunk)
+		if err = c.jobProgress(ctx, j, res.Published, len(companies), nil); err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
@@ -2,16 +2,34 @@ package compman
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 
 	"github.com/jmakaron/compman/internal/app/compman/config"
 	"github.com/jmakaron/compman/internal/app/compman/store"
 	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
 	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
 	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+	"github.com/jmakaron/compman/internal/pkg/requestid"
+	"github.com/jmakaron/compman/internal/pkg/tracing"
 	"github.com/jmakaron/compman/pkg/logger"
 )
 
+const (
+	// serviceName identifies the service in the traces
+	serviceName = "compman"
+	// flushTimeout bounds the delivery of the queued kafka events and the
+	// export of the spans on shutdown
+	flushTimeout           = 5 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+)
+
 type ServiceComponent struct {
 	log *logger.Logger
 	cfg *config.AppConfig
@@ -19,25 +37,66 @@ type ServiceComponent struct {
 	st store.Store
 	ep *httpsrv.HTTPService
 	kp kp.KafkaProducer
+	// responses of the requests sent with an Idempotency-Key
+	idem httpsrv.IdempotencyStore
 
 	ctx    context.Context
 	cancel context.CancelFunc
+	// flushes the spans and stops tracing
+	stopTracing func(context.Context) error
+
+	// background workers, e.g. the scheduler of effective-dated changes
+	workers     sync.WaitGroup
+	stopWorkers context.CancelFunc
+	// heartbeats of the workers, checked by the readiness probe
+	health workerHealth
 }
 
 func New(log *logger.Logger) *ServiceComponent {
 	return &ServiceComponent{log: log}
 }
 
+// reqLog returns the logger of the request of ctx, its lines carry the
+// request id
+func (c *ServiceComponent) reqLog(ctx context.Context) *logger.Logger {
+	if id := requestid.From(ctx); len(id) > 0 {
+		return &logger.Logger{Logger: c.log.With(zap.String("request_id", id))}
+	}
+	return c.log
+}
+
+// publishCommitted publishes the events of a committed change, failures are
+// logged since the change can not be rolled back anymore
+func (c *ServiceComponent) publishCommitted(ctx context.Context, evts ...kp.KEvent) {
+	if err := c.kp.PublishWithRetry(context.WithoutCancel(ctx), evts...); err != nil {
+		c.reqLog(ctx).Error(fmt.Sprintf("failed to publish %d events of a committed change, %+v", len(evts), err))
+	}
+}
+
 func (c *ServiceComponent) Init(cfg *config.AppConfig) error {
 	c.cfg = cfg
 	c.st = postgres.New(c.cfg.Db)
+	// stores exporting their own statistics, e.g. of their connection pool
+	if col, ok := c.st.(prometheus.Collector); ok {
+		var are prometheus.AlreadyRegisteredError
+		if err := prometheus.Register(col); err != nil && !errors.As(err, &are) {
+			return err
+		}
+	}
 	c.kp = kp.New(c.cfg.Kp)
 	c.ep = &httpsrv.HTTPService{}
+	c.idem = c.newIdempotencyStore()
 	return nil
 }
 
 func (c *ServiceComponent) Start() error {
 	c.ctx, c.cancel = context.WithCancel(context.Background())
+	stopTracing, err := tracing.Init(c.ctx, c.cfg.Tracing, serviceName)
+	if err != nil {
+		c.log.Debug("could not initialize tracing")
+		return err
+	}
+	c.stopTracing = stopTracing
 	if err := c.st.Connect(c.ctx); err != nil {
 		c.log.Debug("could not connect to db")
 		return err
@@ -47,27 +106,68 @@ func (c *ServiceComponent) Start() error {
 		c.st.Disconnect()
 		return err
 	}
-	layout, spec := c.getRestAPI()
-	if err := c.ep.Init(c.cfg.HttpCfg, layout, spec, c.log); err != nil {
+	if err := c.ep.Init(c.cfg.HttpCfg, c.getRestAPI(), c.log); err != nil {
 		c.log.Debug("could not initialize http service component")
-		c.kp.Disconnect()
+		c.kp.Disconnect(c.ctx)
 		c.st.Disconnect()
 		return err
 	}
 	if err := c.ep.Start(); err != nil {
 		c.log.Debug("could not start http service component")
-		c.kp.Disconnect()
+		c.kp.Disconnect(c.ctx)
 		c.st.Disconnect()
 		return err
 	}
+	var wctx context.Context
+	wctx, c.stopWorkers = context.WithCancel(c.ctx)
+	c.workers.Add(2)
+	go c.runScheduler(wctx)
+	go c.runIdempotencyPurge(wctx)
+	c.startJobWorkers(wctx)
 	return nil
 }
 
+// Stop drains the service and tears it down in order: the listener stops
+// accepting, the requests in flight and the workers are awaited until the
+// shutdown timeout, the kafka events are flushed and the store is closed.
+// The requests, workers and events cut off are reported.
 func (c *ServiceComponent) Stop() {
-	if err := c.ep.Stop(); err != nil {
-		c.log.Error(fmt.Sprintf("failed to stop http service component, %+v", err))
+	// readiness fails first, so that load balancers stop routing requests
+	c.ep.Drain()
+	timeout := time.Duration(c.cfg.ShutdownTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c.stopWorkers()
+	if err := c.ep.Stop(ctx); err != nil {
+		c.log.Error(fmt.Sprintf("failed to drain http service component, %+v", err))
+	}
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.log.Error(fmt.Sprintf("background workers cut off after %s: %s", timeout,
+			strings.Join(c.health.running(), ", ")))
+		// aborts the queries of the workers, so that the store can be closed
+		c.cancel()
+		<-done
+	}
+	fctx, fcancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer fcancel()
+	if err := c.kp.Disconnect(fctx); err != nil {
+		c.log.Error(fmt.Sprintf("failed to flush kafka producer, %+v", err))
 	}
 	c.st.Disconnect()
-	c.kp.Disconnect()
+	tctx, tcancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer tcancel()
+	if err := c.stopTracing(tctx); err != nil {
+		c.log.Error(fmt.Sprintf("failed to flush spans, %+v", err))
+	}
 	c.cancel()
 }
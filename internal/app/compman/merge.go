@@ -0,0 +1,119 @@
+package compman
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+)
+
+// companyMergeHandler merges duplicate companies into a survivor in a single
+// transaction: the survivor fields are resolved by the merge rules, the
+// duplicates are soft deleted pointing to the survivor. The merge event and
+// the survivor update are published once committed.
+func (c *ServiceComponent) companyMergeHandler(w http.ResponseWriter, r *http.Request) error {
+	var m types.CompanyMerge
+	err := httpsrv.DecodeJSON(r, &m)
+	if err != nil {
+		return err
+	}
+	for _, id := range append([]string{m.SurvivorID}, m.DuplicateIDs...) {
+		if err = uuid.Validate(id); err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+	}
+	if err = m.Validate(); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	ce, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(ce)
+	merger, ok := ce.(store.Merger)
+	if !ok {
+		return httpsrv.NewError(http.StatusNotImplemented, errors.New("store does not support merging companies"))
+	}
+	if err = ce.PrepareSelect(map[string]interface{}{
+		types.FilterIDs:  append([]string{m.SurvivorID}, m.DuplicateIDs...),
+		types.FilterLock: true,
+	}); err != nil {
+		return err
+	}
+	if err = ce.Select(ctx); err != nil {
+		return err
+	}
+	i, err := ce.Value()
+	if err != nil {
+		return err
+	}
+	res := types.CompanyMergeResult{Merged: []*types.Company{}}
+	for _, cmp := range i.([]*types.Company) {
+		if cmp.ID == m.SurvivorID {
+			res.Survivor = cmp
+		} else {
+			res.Merged = append(res.Merged, cmp)
+		}
+	}
+	// merged companies are not selected, so they can not be merged again
+	if res.Survivor == nil || len(res.Merged) != len(m.DuplicateIDs) {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	update := m.ResolveMerge(res.Survivor, res.Merged)
+	// duplicates are merged first, releasing their names for the survivor
+	if err = merger.PrepareMerge(&m); err != nil {
+		return err
+	}
+	if err = merger.Merge(ctx); err != nil {
+		return err
+	}
+	if i, err = ce.Value(); err != nil {
+		return err
+	}
+	res.Merged = i.([]*types.Company)
+	evts := []kp.KEvent{}
+	if len(update) > 0 {
+		update["id"] = m.SurvivorID
+		if err = ce.PrepareUpdate(update); err != nil {
+			return err
+		}
+		if err = ce.Update(ctx); err != nil {
+			return err
+		}
+		if i, err = ce.Value(); err != nil {
+			return err
+		}
+		res.Survivor = i.([]*types.Company)[0]
+		evt, err := types.NewKafkaCompanyEvent(res.Survivor, types.ChangeKindUpdate)
+		if err != nil {
+			return err
+		}
+		evts = append(evts, evt)
+	}
+	evts = append(evts, types.NewKafkaMergeEvent(&res))
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	c.publishCommitted(ctx, evts...)
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
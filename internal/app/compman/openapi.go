@@ -0,0 +1,40 @@
+package compman
+
+import (
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+)
+
+var (
+	companyIDParam = httpsrv.Param{Name: "id1", Description: "company id"}
+	asOfParam      = httpsrv.Param{Name: types.FilterAsOf, Description: "RFC 3339 timestamp of a past state"}
+	forceParam     = httpsrv.Param{Name: "force", Type: "boolean", Description: "skip the duplicate check"}
+	statusParam    = httpsrv.Param{Name: types.FilterStatus}
+)
+
+// companyQuery are the query parameters of the company list and of the
+// statistics
+var companyQuery = []httpsrv.Param{
+	{Name: types.FilterName, Description: "case insensitive substring of the name"},
+	{Name: types.FilterType},
+	{Name: types.FilterState},
+	{Name: types.FilterRegistered, Type: "boolean"},
+	{Name: types.FilterMinEmployees, Type: "integer"},
+	{Name: types.FilterMaxEmployees, Type: "integer"},
+	{Name: types.FilterCreatedSince, Description: "RFC 3339 timestamp"},
+	{Name: types.FilterUpdatedSince, Description: "RFC 3339 timestamp"},
+	{Name: types.FilterCreatedBy},
+	{Name: types.FilterUpdatedBy},
+	{Name: types.FilterSort, Description: "name, employee_count, created_at or updated_at, prefixed with - for descending order"},
+	asOfParam,
+}
+
+// apiDoc documents the service for the OpenAPI document, its routes are
+// documented in the layout of getRestAPI
+func apiDoc() *httpsrv.APIDoc {
+	return &httpsrv.APIDoc{
+		Title:       "compman",
+		Version:     "1.0",
+		Description: "a company-management microservice",
+	}
+}
@@ -0,0 +1,137 @@
+package compman
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+	"github.com/jmakaron/compman/internal/pkg/kafka/kp"
+)
+
+// replaceableFields are the fields a PUT replaces, the state of an existing
+// company only changes through transitions
+var replaceableFields = []string{"name", "description", "employee_count", "type",
+	"lei", "vat", "registry_country", "registry_number"}
+
+// companyReplaceHandler creates the company with the id of the path, or fully
+// replaces it if it exists, answering with 201 or 200. Repeating the request
+// leaves the company unchanged and publishes no event.
+func (c *ServiceComponent) companyReplaceHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	var company types.Company
+	err := httpsrv.DecodeJSON(r, &company)
+	if err != nil {
+		return err
+	}
+	if len(company.ID) > 0 && company.ID != id {
+		return httpError(&types.ValidationError{Fields: []types.FieldError{
+			{Field: "id", Message: "'" + company.ID + "' does not match '" + id + "' of the path"}}})
+	}
+	company.ID = id
+	if err = company.Validate(); err != nil {
+		return httpError(err)
+	}
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	e, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: id, types.FilterLock: true}); err != nil {
+		return err
+	}
+	if err = e.Select(ctx); err != nil {
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	var evt kp.KEvent
+	status := http.StatusOK
+	rv := &company
+	if l := i.([]*types.Company); len(l) == 0 {
+		prepareNewCompany(&company)
+		if r.URL.Query().Get("force") != "true" {
+			if err := c.checkDuplicates(r.Context(), &company); err != nil {
+				return err
+			}
+		}
+		b, err := json.Marshal(&company)
+		if err != nil {
+			return err
+		}
+		if err = e.PrepareInsert(b); err != nil {
+			return err
+		}
+		if err = e.Insert(ctx); err != nil {
+			return httpError(err)
+		}
+		status = http.StatusCreated
+		if i, err = e.Value(); err != nil {
+			return err
+		}
+		rv = i.([]*types.Company)[0]
+		if evt, err = types.NewKafkaCompanyEvent(rv, "insert"); err != nil {
+			return err
+		}
+	} else {
+		rv = l[0]
+		if rv.MergedInto != nil {
+			return httpsrv.NewError(http.StatusConflict, errors.New("company is merged into "+*rv.MergedInto))
+		}
+		from, err := types.CompanyDocument(rv)
+		if err != nil {
+			return err
+		}
+		doc, err := types.CompanyDocument(&company)
+		if err != nil {
+			return err
+		}
+		to := map[string]interface{}{}
+		for k, v := range from {
+			to[k] = v
+		}
+		for _, k := range replaceableFields {
+			to[k] = doc[k]
+		}
+		m := types.PatchChanges(from, to)
+		if err = types.NormalizePatch(rv, m); err != nil {
+			return httpError(err)
+		}
+		if types.RequiresApproval(types.ChangeKindUpdate, m) {
+			tx.Rollback(ctx)
+			return c.proposeChange(w, r, id, types.ChangeKindUpdate, m)
+		}
+		if rv, evt, err = updateCompany(ctx, e, rv, m); err != nil {
+			return httpError(err)
+		}
+	}
+	if evt != nil {
+		if err = tx.Commit(ctx); err != nil {
+			return err
+		}
+		c.publishCommitted(ctx, evt)
+	}
+	b, err := json.Marshal(rv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,327 @@
+package compman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/app/compman/store/postgres"
+	"github.com/jmakaron/compman/internal/app/compman/types"
+	httpsrv "github.com/jmakaron/compman/internal/pkg/http"
+)
+
+const (
+	schedulerLock             = "compman-scheduler"
+	defaultSchedulerInterval  = 10 * time.Second
+	defaultSchedulerBatchSize = 100
+)
+
+// scheduleChange stores the update m of company id, to be applied by the
+// scheduler at effectiveAt, answering with 202 and the scheduled change
+func (c *ServiceComponent) scheduleChange(w http.ResponseWriter, r *http.Request, id string,
+	m map[string]interface{}, effectiveAt time.Time) error {
+	ctx := store.WithActor(r.Context(), httpsrv.User(r))
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	ce, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(ce)
+	if err = ce.PrepareSelect(map[string]interface{}{types.FilterID: id}); err != nil {
+		return err
+	}
+	if err = ce.Select(ctx); err != nil {
+		return err
+	}
+	if i, _ := ce.Value(); len(i.([]*types.Company)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	sc, err := c.insertScheduledChange(ctx, tx, id, m, effectiveAt)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+	return nil
+}
+
+// insertScheduledChange stores the update m of company id in tx, to be
+// applied by the scheduler at effectiveAt
+func (c *ServiceComponent) insertScheduledChange(ctx context.Context, tx store.Tx, id string,
+	m map[string]interface{}, effectiveAt time.Time) (*types.ScheduledChange, error) {
+	se, err := tx.NewEntity(&types.ScheduledChange{})
+	if err != nil {
+		return nil, err
+	}
+	defer c.logQueries(se)
+	sc := types.ScheduledChange{ID: uuid.NewString(), CompanyID: id, Changes: map[string]interface{}{},
+		EffectiveAt: effectiveAt}
+	for k, v := range m {
+		if k != "id" {
+			sc.Changes[k] = v
+		}
+	}
+	if err = se.PrepareInsert(&sc); err != nil {
+		return nil, err
+	}
+	if err = se.Insert(ctx); err != nil {
+		return nil, err
+	}
+	i, err := se.Value()
+	if err != nil {
+		return nil, err
+	}
+	return i.([]*types.ScheduledChange)[0], nil
+}
+
+func (c *ServiceComponent) scheduledChangeListHandler(w http.ResponseWriter, r *http.Request) error {
+	id := httpsrv.GetIdList(r)[0]
+	if err := uuid.Validate(id); err != nil {
+		return httpsrv.NewError(http.StatusBadRequest, err)
+	}
+	filter := map[string]interface{}{types.FilterCompanyID: id}
+	if v := r.URL.Query().Get(types.FilterStatus); len(v) > 0 {
+		status := types.ParseScheduledChangeStatus(v)
+		if status == -1 {
+			return httpsrv.NewError(http.StatusBadRequest, fmt.Errorf("invalid scheduled change status '%s'", v))
+		}
+		filter[types.FilterStatus] = status
+	}
+	e, err := c.st.NewEntity(&types.ScheduledChange{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(filter); err != nil {
+		return err
+	}
+	if err = e.Select(r.Context()); err != nil {
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+func (c *ServiceComponent) scheduledChangeCancelHandler(w http.ResponseWriter, r *http.Request) error {
+	ids := httpsrv.GetIdList(r)
+	for _, id := range ids {
+		if err := uuid.Validate(id); err != nil {
+			return httpsrv.NewError(http.StatusBadRequest, err)
+		}
+	}
+	e, err := c.st.NewEntity(&types.ScheduledChange{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareSelect(map[string]interface{}{types.FilterID: ids[1], types.FilterCompanyID: ids[0]}); err != nil {
+		return err
+	}
+	if err = e.Select(r.Context()); err != nil {
+		return err
+	}
+	if i, _ := e.Value(); len(i.([]*types.ScheduledChange)) == 0 {
+		return httpsrv.NewError(http.StatusNotFound, postgres.ErrNotFound)
+	}
+	if err = e.PrepareUpdate(map[string]interface{}{"id": ids[1], "status": types.ScheduledChangeCancelled}); err != nil {
+		return err
+	}
+	if err = e.Update(r.Context()); err != nil {
+		if errors.Is(err, postgres.ErrNotFound) {
+			// only changes still scheduled can be cancelled
+			return httpsrv.NewError(http.StatusConflict, err)
+		}
+		return err
+	}
+	i, err := e.Value()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(i.([]*types.ScheduledChange)[0])
+	if err != nil {
+		return err
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return nil
+}
+
+// runScheduler applies the due scheduled changes every interval, until ctx is done
+func (c *ServiceComponent) runScheduler(ctx context.Context) {
+	defer c.workers.Done()
+	defer c.health.exit("scheduler")
+	interval := time.Duration(c.cfg.Scheduler.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultSchedulerInterval
+	}
+	batch := c.cfg.Scheduler.BatchSize
+	if batch <= 0 {
+		batch = defaultSchedulerBatchSize
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.health.beat("scheduler", interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for n := 0; n < batch && ctx.Err() == nil; n++ {
+			applied, err := c.applyNextDueChange(ctx)
+			if err != nil {
+				c.log.Error(fmt.Sprintf("scheduler failed to apply due change, %+v", err))
+			}
+			if !applied {
+				break
+			}
+		}
+	}
+}
+
+// applyNextDueChange applies the earliest due scheduled change in its own
+// transaction. The transaction holds the scheduler advisory lock, so that a
+// single replica applies changes at a time, and due changes are selected
+// skipping locked rows. It reports whether a change was processed, changes
+// failing for other reasons than permanentChangeError are retried next tick.
+func (c *ServiceComponent) applyNextDueChange(ctx context.Context) (bool, error) {
+	tx, err := c.st.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	if locked, err := tx.TryLock(ctx, schedulerLock); err != nil || !locked {
+		return false, err
+	}
+	se, err := tx.NewEntity(&types.ScheduledChange{})
+	if err != nil {
+		return false, err
+	}
+	ce, err := tx.NewEntity(&types.Company{})
+	if err != nil {
+		return false, err
+	}
+	defer c.logQueries(se, ce)
+	if err = se.PrepareSelect(map[string]interface{}{
+		types.FilterStatus: types.ScheduledChangeScheduled,
+		types.FilterDue:    time.Now(),
+		types.FilterLimit:  1,
+		types.FilterLock:   true,
+	}); err != nil {
+		return false, err
+	}
+	if err = se.Select(ctx); err != nil {
+		return false, err
+	}
+	i, err := se.Value()
+	if err != nil {
+		return false, err
+	}
+	if len(i.([]*types.ScheduledChange)) == 0 {
+		return false, nil
+	}
+	sc := i.([]*types.ScheduledChange)[0]
+	actx := store.WithActor(ctx, sc.CreatedBy)
+	m := map[string]interface{}{}
+	for k, v := range sc.Changes {
+		m[k] = v
+	}
+	// the company is locked, its registry completes a change of one of
+	// registry_country or registry_number
+	company, err := selectCompany(ctx, ce, sc.CompanyID, true)
+	if err == nil {
+		err = types.NormalizePatch(company, m)
+	}
+	if err == nil {
+		err = ce.PrepareUpdate(m)
+	}
+	if err == nil {
+		err = ce.Update(actx)
+	}
+	if permanentChangeError(err) {
+		tx.Rollback(ctx)
+		return true, c.failScheduledChange(ctx, sc, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	if i, err = ce.Value(); err != nil {
+		return false, err
+	}
+	evt, err := types.NewKafkaCompanyEvent(i.([]*types.Company)[0], types.ChangeKindUpdate)
+	if err != nil {
+		return false, err
+	}
+	if err = se.PrepareUpdate(map[string]interface{}{"id": sc.ID, "status": types.ScheduledChangeApplied}); err != nil {
+		return false, err
+	}
+	if err = se.Update(ctx); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	c.publishCommitted(ctx, evt)
+	c.log.Info(fmt.Sprintf("applied scheduled change %s of company %s", sc.ID, sc.CompanyID))
+	return true, nil
+}
+
+// permanentChangeError tells whether err fails a scheduled change for good,
+// e.g. an invalid change or a deleted company, other errors such as a lost
+// connection are transient
+func permanentChangeError(err error) bool {
+	var ve *types.ValidationError
+	return errors.As(err, &ve) || errors.Is(err, types.ErrInvalidPatch) ||
+		errors.Is(err, types.ErrInvalidIdentifier) || errors.Is(err, postgres.ErrInvalidArg) ||
+		errors.Is(err, postgres.ErrMissingArg) || errors.Is(err, postgres.ErrNotFound) ||
+		// a unique value taken since, retrying would block the later changes
+		errors.Is(err, postgres.ErrDuplicate)
+}
+
+// failScheduledChange records why sc could not be applied, outside of the
+// aborted transaction that tried to apply it
+func (c *ServiceComponent) failScheduledChange(ctx context.Context, sc *types.ScheduledChange, cause error) error {
+	c.log.Error(fmt.Sprintf("failed to apply scheduled change %s of company %s, %+v", sc.ID, sc.CompanyID, cause))
+	e, err := c.st.NewEntity(&types.ScheduledChange{})
+	if err != nil {
+		return err
+	}
+	defer c.logQueries(e)
+	if err = e.PrepareUpdate(map[string]interface{}{
+		"id":     sc.ID,
+		"status": types.ScheduledChangeFailed,
+		"error":  cause.Error(),
+	}); err != nil {
+		return err
+	}
+	return e.Update(ctx)
+}
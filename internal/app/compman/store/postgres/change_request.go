@@ -0,0 +1,200 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/jmakaron/compman/internal/app/compman/types"
+)
+
+const (
+	changeRequestsTable string = "change_requests"
+
+	colCompanyId  string = "company_id"
+	colKind       string = "kind"
+	colChanges    string = "changes"
+	colStatus     string = "status"
+	colProposedBy string = "proposed_by"
+	colProposedAt string = "proposed_at"
+	colDecidedBy  string = "decided_by"
+	colDecidedAt  string = "decided_at"
+)
+
+var changeRequestCols = strings.Join([]string{colId, colCompanyId, colKind, colChanges, colStatus,
+	colProposedBy, colProposedAt, colDecidedBy, colDecidedAt}, ", ")
+
+type changeRequestEntity struct {
+	entity
+	val []*types.ChangeRequest
+}
+
+func (e *changeRequestEntity) reset() {
+	e.buff.Reset()
+	e.qa = []interface{}{}
+	e.val = []*types.ChangeRequest{}
+	e.actor = 0
+}
+
+func scanChangeRequest(row pgx.Row) (*types.ChangeRequest, error) {
+	var id, companyId uuid.UUID
+	var cr types.ChangeRequest
+	var decidedBy *string
+	if err := row.Scan(&id, &companyId, &cr.Kind, &cr.Changes, &cr.Status,
+		&cr.ProposedBy, &cr.ProposedAt, &decidedBy, &cr.DecidedAt); err != nil {
+		return nil, err
+	}
+	if decidedBy != nil {
+		cr.DecidedBy = *decidedBy
+	}
+	cr.ID = id.String()
+	cr.CompanyID = companyId.String()
+	return &cr, nil
+}
+
+func (e *changeRequestEntity) queryRow(ctx context.Context) error {
+	return e.entity.queryRow(ctx, func(row pgx.Row) error {
+		cr, err := scanChangeRequest(row)
+		if err == nil {
+			e.val = []*types.ChangeRequest{cr}
+		}
+		return err
+	})
+}
+
+func (e *changeRequestEntity) PrepareInsert(v interface{}) error {
+	var err error
+	var cr types.ChangeRequest
+	switch t := v.(type) {
+	case []byte:
+		err = json.Unmarshal(t, &cr)
+	case *types.ChangeRequest:
+		cr = *t
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.ChangeRequest{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "INSERT INTO %s (%s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, now()) RETURNING %s;",
+		changeRequestsTable, colId, colCompanyId, colKind, colChanges, colProposedBy, colProposedAt, changeRequestCols)
+	e.qa = []interface{}{cr.ID, cr.CompanyID, cr.Kind, cr.Changes, nil}
+	e.actor = 5
+	return nil
+}
+
+func (e *changeRequestEntity) Insert(ctx context.Context) error {
+	e.bindActor(ctx)
+	return e.queryRow(ctx)
+}
+
+func (e *changeRequestEntity) PrepareSelect(v interface{}) error {
+	m, err := parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.ChangeRequest{}
+	e.qa = []interface{}{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s FROM %s", changeRequestCols, changeRequestsTable)
+	conds := []string{}
+	for _, f := range [][2]string{
+		{types.FilterID, colId}, {types.FilterCompanyID, colCompanyId}, {types.FilterStatus, colStatus}} {
+		k, col := f[0], f[1]
+		if v, ok := m[k]; ok {
+			e.qa = append(e.qa, v)
+			conds = append(conds, fmt.Sprintf("%s=$%d", col, len(e.qa)))
+		}
+	}
+	if len(conds) > 0 {
+		fmt.Fprintf(&e.buff, " WHERE %s", strings.Join(conds, " AND "))
+	}
+	fmt.Fprintf(&e.buff, " ORDER BY %s", colProposedAt)
+	if lock, _ := m[types.FilterLock].(bool); lock {
+		fmt.Fprintf(&e.buff, " FOR UPDATE")
+	}
+	fmt.Fprintf(&e.buff, ";")
+	return nil
+}
+
+func (e *changeRequestEntity) Select(ctx context.Context) error {
+	e.val = []*types.ChangeRequest{}
+	return e.query(ctx, func(rows pgx.Rows) error {
+		cr, err := scanChangeRequest(rows)
+		if err == nil {
+			e.val = append(e.val, cr)
+		}
+		return err
+	})
+}
+
+// PrepareUpdate records the decision on a pending change request, the map
+// holds its id and the new status
+func (e *changeRequestEntity) PrepareUpdate(v interface{}) error {
+	var err error
+	var id, status interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		var ok1, ok2 bool
+		id, ok1 = t[colId]
+		status, ok2 = t[colStatus]
+		if !ok1 || !ok2 {
+			err = ErrMissingArg
+		}
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "UPDATE %s SET %s=$1, %s=$2, %s=now() WHERE %s=$3 AND %s=$4 RETURNING %s;",
+		changeRequestsTable, colStatus, colDecidedBy, colDecidedAt, colId, colStatus, changeRequestCols)
+	e.qa = []interface{}{status, nil, id, types.ChangeRequestPending}
+	e.actor = 2
+	return nil
+}
+
+func (e *changeRequestEntity) Update(ctx context.Context) error {
+	e.bindActor(ctx)
+	return e.queryRow(ctx)
+}
+
+func (e *changeRequestEntity) PrepareDelete(v interface{}) error {
+	var err error
+	e.qa = []interface{}{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if i, ok := t[colId]; ok {
+			e.buff.Reset()
+			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s=$1 RETURNING %s;", changeRequestsTable, colId, changeRequestCols)
+			e.qa = append(e.qa, i)
+		} else {
+			err = ErrMissingArg
+		}
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	return nil
+}
+
+func (e *changeRequestEntity) Delete(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+func (e *changeRequestEntity) Value() (interface{}, error) {
+	return e.val, nil
+}
@@ -21,143 +21,120 @@ var (
 	ErrNotFound        = errors.New("not found")
 	ErrMissingArg      = errors.New("missing argument")
 	ErrInvalidArg      = errors.New("invalid argument")
+	ErrDuplicate       = errors.New("duplicate value")
 )
 
 const (
 	companiesTable string = "companies"
+	historyTable   string = "company_history"
 
 	colId          string = "id"
 	colName        string = "name"
 	colDesc        string = "description"
 	colEmployeeCnt string = "employee_count"
-	colRegistered  string = "registered"
-	colCType       string = "company_type"
+	colState       string = "state"
+	colCType       string = "type"
+	colCreatedAt   string = "created_at"
+	colUpdatedAt   string = "updated_at"
+	colCreatedBy   string = "created_by"
+	colUpdatedBy   string = "updated_by"
+	colValidFrom   string = "valid_from"
+	colValidTo     string = "valid_to"
+	colMergedInto  string = "merged_into"
+	colLEI         string = "lei"
+	colVAT         string = "vat"
+	colRegCountry  string = "registry_country"
+	colRegNumber   string = "registry_number"
+	// colNormName holds the normalised name, for the duplicate candidates
+	colNormName string = "norm_name"
 )
 
-type companyEntity struct {
-	st   *pgStore
-	buff strings.Builder
-	qa   []interface{}
-	val  []*types.Company
-	ql   []store.QueryLogEntry
+// companyCols is the column list of every company query, in scan order
+var companyCols = strings.Join([]string{colId, colName, colDesc, colEmployeeCnt, colState, colCType,
+	colCreatedAt, colUpdatedAt, colCreatedBy, colUpdatedBy, colMergedInto, colLEI, colVAT, colRegCountry, colRegNumber}, ", ")
+
+// columns maintained by the store, they can not be set through PrepareUpdate
+var readOnlyCols = map[string]struct{}{
+	colCreatedAt: {}, colUpdatedAt: {}, colCreatedBy: {}, colUpdatedBy: {}, colMergedInto: {},
 }
 
-func (e *companyEntity) logQuery(qs string, qa []interface{}, start time.Time, end time.Time) {
-	if e.ql == nil {
-		e.ql = []store.QueryLogEntry{}
-	}
-	e.ql = append(e.ql, store.QueryLogEntry{qs, qa, start, end})
+// columns PrepareUpdate may set, other keys of the update map are rejected
+// so that they never end up in the statement
+var updateCols = map[string]struct{}{
+	colName: {}, colDesc: {}, colEmployeeCnt: {}, colState: {}, colCType: {},
+	colLEI: {}, colVAT: {}, colRegCountry: {}, colRegNumber: {},
 }
 
-func (e *companyEntity) QueryLog() []store.QueryLogEntry {
-	return e.ql
+// sortable columns of the list, FilterSort values may be prefixed with '-' for descending order
+var sortCols = map[string]struct{}{
+	colName: {}, colEmployeeCnt: {}, colCreatedAt: {}, colUpdatedAt: {},
+}
+
+type companyEntity struct {
+	entity
+	filter map[string]interface{}
+	val    []*types.Company
 }
 
 func (e *companyEntity) reset() {
 	e.buff.Reset()
 	e.qa = []interface{}{}
 	e.val = []*types.Company{}
+	e.actor = 0
 }
 
-func (e *companyEntity) exec(ctx context.Context) error {
-	tnow := time.Now()
-	conn, err := e.st.p.Acquire(e.st.ctx)
-	if err != nil {
-		return err
+func scanCompany(row pgx.Row) (*types.Company, error) {
+	var id uuid.UUID
+	var mergedInto *uuid.UUID
+	var c types.Company
+	var d sql.NullString
+	if err := row.Scan(&id, &c.Name, &d, &c.EmployeeCnt, &c.State, &c.CType,
+		&c.CreatedAt, &c.UpdatedAt, &c.CreatedBy, &c.UpdatedBy, &mergedInto,
+		&c.LEI, &c.VAT, &c.RegistryCountry, &c.RegistryNumber); err != nil {
+		return nil, err
 	}
-	defer func() {
-		conn.Release()
-		if err == nil {
-			e.logQuery(e.buff.String(), e.qa, tnow, time.Now())
-		}
-	}()
-	if len(e.qa) > 0 {
-		_, err = conn.Exec(ctx, e.buff.String(), e.qa...)
-	} else {
-		_, err = conn.Exec(ctx, e.buff.String())
+	if mergedInto != nil {
+		s := mergedInto.String()
+		c.MergedInto = &s
 	}
-	return err
+	c.Registered = c.State.Registered()
+	if d.Valid {
+		c.Desc = &d.String
+	}
+	c.ID = id.String()
+	return &c, nil
 }
 
 func (e *companyEntity) queryRow(ctx context.Context) error {
-	tnow := time.Now()
-	conn, err := e.st.p.Acquire(e.st.ctx)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		conn.Release()
-		if err == nil || errors.Is(err, ErrNotFound) {
-			e.logQuery(e.buff.String(), e.qa, tnow, time.Now())
-		}
-	}()
-	row := conn.QueryRow(ctx, e.buff.String(), e.qa...)
-	var id uuid.UUID
-	var c types.Company
-	if err := row.Scan(&id, &c.Name, &c.Desc, &c.EmployeeCnt, &c.Registered, &c.CType); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return ErrNotFound
+	return e.entity.queryRow(ctx, func(row pgx.Row) error {
+		c, err := scanCompany(row)
+		if err == nil {
+			e.val = []*types.Company{c}
 		}
 		return err
-	}
-	c.ID = id.String()
-	e.val = []*types.Company{&c}
-	return nil
+	})
 }
 
-func (e *companyEntity) parseRows(rows pgx.Rows) error {
+func (e *companyEntity) query(ctx context.Context) error {
 	e.val = []*types.Company{}
-	for rows.Next() {
-		var id uuid.UUID
-		var c types.Company
-		var d sql.NullString
-		if err := rows.Scan(&id, &c.Name, &d, &c.EmployeeCnt, &c.Registered, &c.CType); err != nil {
-			return err
-		}
-		if d.Valid {
-			c.Desc = &d.String
+	return e.entity.query(ctx, func(rows pgx.Rows) error {
+		c, err := scanCompany(rows)
+		if err == nil {
+			e.val = append(e.val, c)
 		}
-		c.ID = id.String()
-		e.val = append(e.val, &c)
-	}
-	return nil
-}
-
-func (e *companyEntity) query(ctx context.Context) error {
-	tnow := time.Now()
-	conn, err := e.st.p.Acquire(e.st.ctx)
-	if err != nil {
 		return err
-	}
-	defer func() {
-		conn.Release()
-		if err == nil || errors.Is(err, ErrNotFound) {
-			e.logQuery(e.buff.String(), e.qa, tnow, time.Now())
-		}
-	}()
-	var rows pgx.Rows
-	if len(e.qa) > 0 {
-		rows, err = conn.Query(ctx, e.buff.String(), e.qa...)
-	} else {
-		rows, err = conn.Query(ctx, e.buff.String())
-	}
-	if err == nil {
-		err = e.parseRows(rows)
-		if errors.Is(err, pgx.ErrNoRows) {
-			return ErrNotFound
-		}
-	}
-	rows.Close()
-	return err
+	})
 }
 
 func (e *companyEntity) PrepareInsert(v interface{}) error {
 	var err error
 	e.val = []*types.Company{}
-	e.qa = make([]interface{}, 6)
+	e.qa = make([]interface{}, 16)
 	e.buff.Reset()
-	fmt.Fprintf(&e.buff, "INSERT INTO %s VALUES ($1, $2, $3, $4, $5, $6);",
-		companiesTable)
+	// metadata is kept when given, so a deleted company can be restored as it was
+	e.buff.WriteString(withHistory(fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES ($1, $2, $3, $4, $5, $6, "+
+		"coalesce($7, now()), coalesce($8, now()), coalesce($9, $11), coalesce($10, $11), NULL, $12, $13, $14, $15, $16)",
+		companiesTable, companyCols, colNormName), true))
 	var c types.Company
 	switch t := v.(type) {
 	case []byte:
@@ -174,8 +151,26 @@ func (e *companyEntity) PrepareInsert(v interface{}) error {
 	e.qa[1] = c.Name
 	e.qa[2] = c.Desc
 	e.qa[3] = c.EmployeeCnt
-	e.qa[4] = c.Registered
+	e.qa[4] = c.State
 	e.qa[5] = c.CType
+	if !c.CreatedAt.IsZero() {
+		e.qa[6] = c.CreatedAt
+	}
+	if !c.UpdatedAt.IsZero() {
+		e.qa[7] = c.UpdatedAt
+	}
+	if len(c.CreatedBy) > 0 {
+		e.qa[8] = c.CreatedBy
+	}
+	if len(c.UpdatedBy) > 0 {
+		e.qa[9] = c.UpdatedBy
+	}
+	e.qa[11] = c.LEI
+	e.qa[12] = c.VAT
+	e.qa[13] = c.RegistryCountry
+	e.qa[14] = c.RegistryNumber
+	e.qa[15] = types.NormalizeName(c.Name)
+	e.actor = 11
 	return nil
 }
 
@@ -183,13 +178,84 @@ func (e *companyEntity) Insert(ctx context.Context) error {
 	if e.st == nil {
 		return store.ErrNotConnected
 	}
-	return e.exec(ctx)
+	e.bindActor(ctx)
+	return e.queryRow(ctx)
 }
 
 func (e *companyEntity) PrepareSelect(v interface{}) error {
 	var err error
 	e.val = []*types.Company{}
 	e.qa = []interface{}{}
+	e.filter, err = parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s FROM %s", companyCols, e.table())
+	if err = e.limitSimilar(); err != nil {
+		e.reset()
+		return err
+	}
+	e.where(e.filter)
+	if v, ok := e.filter[types.FilterSimilarTo]; ok {
+		// nearest first, by trigram distance of the normalised names
+		e.qa = append(e.qa, types.NormalizeName(fmt.Sprint(v)))
+		fmt.Fprintf(&e.buff, " ORDER BY %s <-> $%d, %s", colNormName, len(e.qa), colId)
+	} else if _, ok := e.filter[types.FilterHasSimilar]; ok {
+		fmt.Fprintf(&e.buff, " ORDER BY %s, %s", colNormName, colId)
+	} else if v, ok := e.filter[types.FilterSort]; ok {
+		col, order := fmt.Sprint(v), "ASC"
+		if strings.HasPrefix(col, "-") {
+			col, order = col[1:], "DESC"
+		}
+		if _, ok := sortCols[col]; !ok {
+			e.reset()
+			return ErrInvalidArg
+		}
+		fmt.Fprintf(&e.buff, " ORDER BY %s %s, %s", col, order, colId)
+	}
+	if v, ok := e.filter[types.FilterLimit]; ok {
+		e.qa = append(e.qa, v)
+		fmt.Fprintf(&e.buff, " LIMIT $%d", len(e.qa))
+	}
+	if lock, _ := e.filter[types.FilterLock].(bool); lock {
+		fmt.Fprintf(&e.buff, " FOR UPDATE")
+	}
+	fmt.Fprintf(&e.buff, ";")
+	return nil
+}
+
+// limitSimilar checks the filters on the normalised names and caps the
+// companies they select, the normalised names are not kept in the history
+func (e *companyEntity) limitSimilar() error {
+	_, to := e.filter[types.FilterSimilarTo]
+	_, has := e.filter[types.FilterHasSimilar]
+	if !to && !has {
+		return nil
+	}
+	_, asOf := e.filter[types.FilterAsOf]
+	_, sorted := e.filter[types.FilterSort]
+	if (to && has) || asOf || sorted {
+		return ErrInvalidArg
+	}
+	if _, ok := e.filter[types.FilterLimit]; !ok {
+		// the filter may be the one of the caller
+		m := make(map[string]interface{}, len(e.filter)+1)
+		for k, v := range e.filter {
+			m[k] = v
+		}
+		m[types.FilterLimit] = types.DuplicateClusterCandidates
+		if to {
+			m[types.FilterLimit] = types.DuplicateCandidates
+		}
+		e.filter = m
+	}
+	return nil
+}
+
+func parseFilter(v interface{}) (map[string]interface{}, error) {
+	var err error
 	m := map[string]interface{}{}
 	switch t := v.(type) {
 	case map[string]interface{}:
@@ -199,18 +265,107 @@ func (e *companyEntity) PrepareSelect(v interface{}) error {
 	default:
 		err = ErrUnsupportedType
 	}
-	if err != nil {
-		e.reset()
-		return err
+	return m, err
+}
+
+// table returns the table selected from, the company history for filters
+// with FilterAsOf
+func (e *companyEntity) table() string {
+	if _, ok := e.filter[types.FilterAsOf]; ok {
+		return historyTable
 	}
-	e.buff.Reset()
-	fmt.Fprintf(&e.buff, "SELECT * FROM %s", companiesTable)
-	if id, ok := m[colId]; ok {
-		fmt.Fprintf(&e.buff, " WHERE %s=$1", colId)
-		e.qa = append(e.qa, id)
+	return companiesTable
+}
+
+// withHistory wraps the data modifying statement stmt on the companies table
+// so that the company history is kept by the same statement: the current
+// history rows of the affected companies are closed and, when keep is set,
+// their new values are recorded
+func withHistory(stmt string, keep bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "WITH c AS (%s RETURNING %s), h AS (UPDATE %s SET %s=now() WHERE %s IN (SELECT %s FROM c) AND %s IS NULL)",
+		stmt, companyCols, historyTable, colValidTo, colId, colId, colValidTo)
+	if keep {
+		fmt.Fprintf(&b, ", v AS (INSERT INTO %s (%s, %s) SELECT %s, now() FROM c)",
+			historyTable, companyCols, colValidFrom, companyCols)
+	}
+	fmt.Fprintf(&b, " SELECT %s FROM c;", companyCols)
+	return b.String()
+}
+
+// where appends the WHERE clause for the given filter to the query buffer
+func (e *companyEntity) where(m map[string]interface{}) {
+	conds := []string{}
+	add := func(cond string, v interface{}) {
+		e.qa = append(e.qa, v)
+		conds = append(conds, fmt.Sprintf(cond, len(e.qa)))
+	}
+	if v, ok := m[types.FilterAsOf]; ok {
+		add(fmt.Sprintf("%s<=$%%[1]d AND (%s IS NULL OR %s>$%%[1]d)", colValidFrom, colValidTo, colValidTo), v)
+	}
+	if v, ok := m[types.FilterID]; ok {
+		add(colId+"=$%d", v)
+	} else {
+		conds = append(conds, colMergedInto+" IS NULL")
+	}
+	if v, ok := m[types.FilterIDs]; ok {
+		add(colId+"=ANY($%d)", v)
+	}
+	if v, ok := m[types.FilterName]; ok {
+		add(colName+" ILIKE '%%' || $%d || '%%'", v)
+	}
+	if v, _ := m[types.FilterHasSimilar].(bool); v {
+		// % is the trigram similarity of pg_trgm, served by the index on norm_name
+		conds = append(conds, fmt.Sprintf("EXISTS (SELECT 1 FROM %s d WHERE d.%s IS NULL AND d.%s<>%s.%s AND d.%s %% %s.%s)",
+			companiesTable, colMergedInto, colId, companiesTable, colId, colNormName, companiesTable, colNormName))
+	}
+	if v, ok := m[types.FilterType]; ok {
+		add(colCType+"=$%d", v)
+	}
+	if v, ok := m[types.FilterState]; ok {
+		add(colState+"=$%d", v)
+	}
+	if v, ok := m[types.FilterRegistered]; ok {
+		states := make([]int, len(types.RegisteredStates))
+		for i, st := range types.RegisteredStates {
+			states[i] = int(st)
+		}
+		if registered, _ := v.(bool); registered {
+			add(colState+"=ANY($%d)", states)
+		} else {
+			add("NOT "+colState+"=ANY($%d)", states)
+		}
+	}
+	if v, ok := m[types.FilterMinEmployees]; ok {
+		add(colEmployeeCnt+">=$%d", v)
+	}
+	if v, ok := m[types.FilterMaxEmployees]; ok {
+		add(colEmployeeCnt+"<=$%d", v)
+	}
+	if v, ok := m[types.FilterCreatedSince]; ok {
+		add(colCreatedAt+">=$%d", v)
+	}
+	if v, ok := m[types.FilterUpdatedSince]; ok {
+		add(colUpdatedAt+">=$%d", v)
+	}
+	if v, ok := m[types.FilterCreatedBy]; ok {
+		add(colCreatedBy+"=$%d", v)
+	}
+	if v, ok := m[types.FilterUpdatedBy]; ok {
+		add(colUpdatedBy+"=$%d", v)
+	}
+	for _, f := range [][2]string{
+		{types.FilterLEI, colLEI},
+		{types.FilterVAT, colVAT},
+		{types.FilterRegistryCountry, colRegCountry},
+		{types.FilterRegistryNumber, colRegNumber}} {
+		if v, ok := m[f[0]]; ok {
+			add(f[1]+"=$%d", v)
+		}
+	}
+	if len(conds) > 0 {
+		fmt.Fprintf(&e.buff, " WHERE %s", strings.Join(conds, " AND "))
 	}
-	fmt.Fprintf(&e.buff, ";")
-	return nil
 }
 
 func (e *companyEntity) Select(ctx context.Context) error {
@@ -230,20 +385,41 @@ func (e *companyEntity) PrepareUpdate(v interface{}) error {
 			var ok bool
 			if i, ok = t[colId]; ok {
 				e.buff.Reset()
-				fmt.Fprintf(&e.buff, "UPDATE %s SET ", companiesTable)
+				stmt := strings.Builder{}
+				fmt.Fprintf(&stmt, "UPDATE %s SET ", companiesTable)
 				cols := []string{}
-				var idx int
+				var idx, skipped, extra int
 				for k, v := range t {
 					if k == colId {
 						continue
 					}
+					if _, ok := readOnlyCols[k]; ok {
+						skipped++
+						continue
+					}
+					if _, ok := updateCols[k]; !ok {
+						e.reset()
+						return fmt.Errorf("%w, '%s' is not a company column", ErrInvalidArg, k)
+					}
 					cols = append(cols, fmt.Sprintf("%s=$%d", k, idx+1))
 					idx++
 					e.qa = append(e.qa, v)
+					if name, ok := v.(string); ok && k == colName {
+						cols = append(cols, fmt.Sprintf("%s=$%d", colNormName, idx+1))
+						idx++
+						extra++
+						e.qa = append(e.qa, types.NormalizeName(name))
+					}
 				}
-				fmt.Fprintf(&e.buff, "%s WHERE %s=$%d RETURNING *;", strings.Join(cols, ","), colId, idx+1)
-				e.qa = append(e.qa, i.(string))
-				if len(e.qa) != len(t) {
+				cols = append(cols, fmt.Sprintf("%s=now()", colUpdatedAt), fmt.Sprintf("%s=$%d", colUpdatedBy, idx+1))
+				e.qa = append(e.qa, nil)
+				e.actor = idx + 1
+				// merged companies are read-only
+				fmt.Fprintf(&stmt, "%s WHERE %s=$%d AND %s IS NULL", strings.Join(cols, ","), colId, idx+2, colMergedInto)
+				e.buff.WriteString(withHistory(stmt.String(), true))
+				id, isStr := i.(string)
+				e.qa = append(e.qa, id)
+				if !isStr || len(e.qa)+skipped != len(t)+extra+1 {
 					err = ErrInvalidArg
 				}
 			} else {
@@ -264,6 +440,7 @@ func (e *companyEntity) Update(ctx context.Context) error {
 	if e.st == nil {
 		return store.ErrNotConnected
 	}
+	e.bindActor(ctx)
 	return e.queryRow(ctx)
 }
 
@@ -274,8 +451,12 @@ func (e *companyEntity) PrepareDelete(v interface{}) error {
 	case map[string]interface{}:
 		if i, ok := t[colId]; ok {
 			e.buff.Reset()
-			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s=$1 RETURNING *;", companiesTable, colId)
-			e.qa = append(e.qa, i.(string))
+			e.buff.WriteString(withHistory(fmt.Sprintf("DELETE FROM %s WHERE %s=$1", companiesTable, colId), false))
+			if id, ok := i.(string); ok {
+				e.qa = append(e.qa, id)
+			} else {
+				err = ErrInvalidArg
+			}
 		} else {
 			err = ErrMissingArg
 		}
@@ -296,6 +477,132 @@ func (e *companyEntity) Delete(ctx context.Context) error {
 	return e.queryRow(ctx)
 }
 
+// PrepareMerge prepares the soft delete of the duplicates of a
+// *types.CompanyMerge, pointing them to the survivor. The change requests and
+// scheduled changes of the duplicates are moved to the survivor, those still
+// pending are rejected or cancelled.
+func (e *companyEntity) PrepareMerge(v interface{}) error {
+	m, ok := v.(*types.CompanyMerge)
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	e.val = []*types.Company{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "WITH cr AS (UPDATE %s SET %s=$1, %s=CASE WHEN %s=%d THEN %d ELSE %s END, "+
+		"%s=CASE WHEN %s=%d THEN $3 ELSE %s END, %s=CASE WHEN %s=%d THEN now() ELSE %s END WHERE %s=ANY($2)), ",
+		changeRequestsTable, colCompanyId, colStatus, colStatus, types.ChangeRequestPending, types.ChangeRequestRejected, colStatus,
+		colDecidedBy, colStatus, types.ChangeRequestPending, colDecidedBy,
+		colDecidedAt, colStatus, types.ChangeRequestPending, colDecidedAt, colCompanyId)
+	fmt.Fprintf(&e.buff, "sc AS (UPDATE %s SET %s=$1, %s=CASE WHEN %s=%d THEN %d ELSE %s END, "+
+		"%s=CASE WHEN %s=%d THEN 'merged into ' || $1 ELSE %s END WHERE %s=ANY($2)) ",
+		scheduledChangesTable, colCompanyId, colStatus, colStatus, types.ScheduledChangeScheduled, types.ScheduledChangeCancelled,
+		colStatus, colError, colStatus, types.ScheduledChangeScheduled, colError, colCompanyId)
+	stmt := fmt.Sprintf("UPDATE %s SET %s=$1, %s=now(), %s=$3 WHERE %s=ANY($2) AND %s IS NULL",
+		companiesTable, colMergedInto, colUpdatedAt, colUpdatedBy, colId, colMergedInto)
+	e.buff.WriteString(strings.Replace(withHistory(stmt, true), "WITH ", ", ", 1))
+	e.qa = []interface{}{m.SurvivorID, m.DuplicateIDs, nil}
+	e.actor = 3
+	return nil
+}
+
+// Merge runs the merge prepared by PrepareMerge, it fails with ErrNotFound
+// unless every duplicate is merged
+func (e *companyEntity) Merge(ctx context.Context) error {
+	if e.st == nil {
+		return store.ErrNotConnected
+	}
+	e.bindActor(ctx)
+	n := len(e.qa[1].([]string))
+	if err := e.query(ctx); err != nil {
+		return err
+	}
+	if len(e.val) != n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (e *companyEntity) PrepareAggregate(v interface{}) error {
+	var err error
+	e.val = []*types.Company{}
+	e.qa = []interface{}{}
+	e.filter, err = parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s, %s, count(*), coalesce(sum(%s), 0) FROM %s",
+		colCType, colState, colEmployeeCnt, e.table())
+	e.where(e.filter)
+	fmt.Fprintf(&e.buff, " GROUP BY %s, %s;", colCType, colState)
+	return nil
+}
+
+// Aggregate runs the grouping query prepared by PrepareAggregate, followed by
+// the employee_count percentiles over the same filter
+func (e *companyEntity) Aggregate(ctx context.Context) (interface{}, error) {
+	ctx, span := e.startSpan(ctx)
+	stats, err := e.aggregate(ctx)
+	endSpan(span, err)
+	return stats, err
+}
+
+func (e *companyEntity) aggregate(ctx context.Context) (interface{}, error) {
+	if e.st == nil {
+		return nil, store.ErrNotConnected
+	}
+	conn, release, err := e.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	stats := types.NewCompanyStats()
+	tnow := time.Now()
+	rows, err := conn.Query(ctx, e.buff.String(), e.qa...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ctype types.CompanyType
+		var state types.CompanyState
+		var cnt int
+		var sum int64
+		if err = rows.Scan(&ctype, &state, &cnt, &sum); err != nil {
+			break
+		}
+		stats.Add(ctype, state, cnt, sum)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.logQuery(ctx, e.buff.String(), e.qa, tnow, time.Now())
+
+	e.buff.Reset()
+	e.qa = []interface{}{types.StatsPercentiles}
+	fmt.Fprintf(&e.buff, "SELECT percentile_cont($1::float8[]) WITHIN GROUP (ORDER BY %s) FROM %s",
+		colEmployeeCnt, e.table())
+	e.where(e.filter)
+	fmt.Fprintf(&e.buff, ";")
+	tnow = time.Now()
+	var pcts []float64
+	if err = conn.QueryRow(ctx, e.buff.String(), e.qa...).Scan(&pcts); err != nil {
+		return nil, err
+	}
+	e.logQuery(ctx, e.buff.String(), e.qa, tnow, time.Now())
+	for i, p := range types.StatsPercentiles {
+		if i < len(pcts) {
+			stats.Employees.Percentiles[types.PercentileLabel(p)] = pcts[i]
+		}
+	}
+	return stats, nil
+}
+
 func (e *companyEntity) Value() (interface{}, error) {
 	return e.val, nil
 }
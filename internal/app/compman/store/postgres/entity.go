@@ -0,0 +1,171 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jmakaron/compman/internal/app/compman/store"
+	"github.com/jmakaron/compman/internal/pkg/requestid"
+)
+
+// querier is implemented by both pool connections and transactions
+type querier interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}
+
+// entity holds the query state shared by the entities of the store, entities
+// created through a transaction run all their queries on it
+type entity struct {
+	st    *pgStore
+	tx    pgx.Tx
+	buff  strings.Builder
+	qa    []interface{}
+	actor int
+	ql    []store.QueryLogEntry
+}
+
+func (e *entity) logQuery(ctx context.Context, qs string, qa []interface{}, start time.Time, end time.Time) {
+	if e.ql == nil {
+		e.ql = []store.QueryLogEntry{}
+	}
+	e.ql = append(e.ql, store.QueryLogEntry{QStr: qs, QArgs: qa, Start: start, End: end,
+		RequestID: requestid.From(ctx)})
+	observeQuery(qs, start, end)
+}
+
+func (e *entity) QueryLog() []store.QueryLogEntry {
+	return e.ql
+}
+
+// bindActor sets the acting user of ctx as the query argument reserved for it
+// by the Prepare* call, if any
+func (e *entity) bindActor(ctx context.Context) {
+	if e.actor > 0 && e.actor <= len(e.qa) {
+		e.qa[e.actor-1] = store.Actor(ctx)
+	}
+}
+
+var tracer = otel.Tracer("github.com/jmakaron/compman/internal/app/compman/store/postgres")
+
+// startSpan starts the span of the prepared query, child of the span of ctx
+func (e *entity) startSpan(ctx context.Context) (context.Context, trace.Span) {
+	qs := e.buff.String()
+	return tracer.Start(ctx, "store "+statement(qs), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBStatement(qs)))
+}
+
+// endSpan ends the span of a query failing with err, missing rows are not
+// errors of the query
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (e *entity) acquire() (querier, func(), error) {
+	if e.st == nil {
+		return nil, nil, store.ErrNotConnected
+	}
+	if e.tx != nil {
+		return e.tx, func() {}, nil
+	}
+	conn, err := e.st.p.Acquire(e.st.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Release, nil
+}
+
+func (e *entity) exec(ctx context.Context) error {
+	ctx, span := e.startSpan(ctx)
+	tnow := time.Now()
+	q, release, err := e.acquire()
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer func() {
+		endSpan(span, err)
+		release()
+		if err == nil {
+			e.logQuery(ctx, e.buff.String(), e.qa, tnow, time.Now())
+		}
+	}()
+	_, err = q.Exec(ctx, e.buff.String(), e.qa...)
+	return err
+}
+
+// mapError maps the unique constraint violations to ErrDuplicate
+func mapError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return fmt.Errorf("%w, %s", ErrDuplicate, pgErr.Detail)
+	}
+	return err
+}
+
+// queryRow runs the prepared query, handing its single row to scan
+func (e *entity) queryRow(ctx context.Context, scan func(pgx.Row) error) error {
+	ctx, span := e.startSpan(ctx)
+	tnow := time.Now()
+	q, release, err := e.acquire()
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer func() {
+		endSpan(span, err)
+		release()
+		if err == nil || errors.Is(err, ErrNotFound) {
+			e.logQuery(ctx, e.buff.String(), e.qa, tnow, time.Now())
+		}
+	}()
+	if err = scan(q.QueryRow(ctx, e.buff.String(), e.qa...)); errors.Is(err, pgx.ErrNoRows) {
+		err = ErrNotFound
+	}
+	return mapError(err)
+}
+
+// query runs the prepared query, handing every row to scan
+func (e *entity) query(ctx context.Context, scan func(pgx.Rows) error) error {
+	ctx, span := e.startSpan(ctx)
+	tnow := time.Now()
+	q, release, err := e.acquire()
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer func() {
+		endSpan(span, err)
+		release()
+		if err == nil {
+			e.logQuery(ctx, e.buff.String(), e.qa, tnow, time.Now())
+		}
+	}()
+	var rows pgx.Rows
+	if rows, err = q.Query(ctx, e.buff.String(), e.qa...); err != nil {
+		return mapError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return mapError(err)
+		}
+	}
+	err = mapError(rows.Err())
+	return err
+}
@@ -0,0 +1,174 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/jmakaron/compman/internal/app/compman/types"
+)
+
+const (
+	idempotencyKeysTable string = "idempotency_keys"
+
+	colKey         string = "key"
+	colFingerprint string = "fingerprint"
+	colContentType string = "content_type"
+	colBody        string = "body"
+	colExpiresAt   string = "expires_at"
+)
+
+var idempotencyCols = strings.Join([]string{colKey, colFingerprint, colStatus, colContentType, colBody,
+	colExpiresAt}, ", ")
+
+type idempotencyEntity struct {
+	entity
+	val []*types.IdempotencyRecord
+}
+
+func (e *idempotencyEntity) reset() {
+	e.buff.Reset()
+	e.qa = []interface{}{}
+	e.val = []*types.IdempotencyRecord{}
+	e.actor = 0
+}
+
+func scanIdempotencyRecord(row pgx.Row) (*types.IdempotencyRecord, error) {
+	var rec types.IdempotencyRecord
+	var contentType *string
+	if err := row.Scan(&rec.Key, &rec.Fingerprint, &rec.Status, &contentType, &rec.Body,
+		&rec.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if contentType != nil {
+		rec.ContentType = *contentType
+	}
+	return &rec, nil
+}
+
+func (e *idempotencyEntity) queryRow(ctx context.Context) error {
+	return e.entity.queryRow(ctx, func(row pgx.Row) error {
+		rec, err := scanIdempotencyRecord(row)
+		if err == nil {
+			e.val = []*types.IdempotencyRecord{rec}
+		}
+		return err
+	})
+}
+
+// PrepareInsert reserves the key of the record, taking over keys that expired
+func (e *idempotencyEntity) PrepareInsert(v interface{}) error {
+	rec, ok := v.(*types.IdempotencyRecord)
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	e.val = []*types.IdempotencyRecord{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) ON CONFLICT (%s) DO UPDATE SET "+
+		"%s=EXCLUDED.%s, %s=0, %s=NULL, %s=NULL, %s=now(), %s=EXCLUDED.%s WHERE %s.%s<=now() RETURNING %s;",
+		idempotencyKeysTable, colKey, colFingerprint, colExpiresAt, colKey,
+		colFingerprint, colFingerprint, colStatus, colContentType, colBody, colCreatedAt, colExpiresAt, colExpiresAt,
+		idempotencyKeysTable, colExpiresAt, idempotencyCols)
+	e.qa = []interface{}{rec.Key, rec.Fingerprint, rec.ExpiresAt}
+	return nil
+}
+
+// Insert fails with ErrDuplicate if the key is reserved and not expired
+func (e *idempotencyEntity) Insert(ctx context.Context) error {
+	err := e.queryRow(ctx)
+	if errors.Is(err, ErrNotFound) {
+		err = fmt.Errorf("%w, idempotency key in use", ErrDuplicate)
+	}
+	return err
+}
+
+// PrepareSelect accepts FilterID to select the record of a key
+func (e *idempotencyEntity) PrepareSelect(v interface{}) error {
+	m, err := parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.IdempotencyRecord{}
+	e.qa = []interface{}{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s FROM %s", idempotencyCols, idempotencyKeysTable)
+	if v, ok := m[types.FilterID]; ok {
+		e.qa = append(e.qa, v)
+		fmt.Fprintf(&e.buff, " WHERE %s=$1", colKey)
+	}
+	fmt.Fprintf(&e.buff, ";")
+	return nil
+}
+
+func (e *idempotencyEntity) Select(ctx context.Context) error {
+	e.val = []*types.IdempotencyRecord{}
+	return e.query(ctx, func(rows pgx.Rows) error {
+		rec, err := scanIdempotencyRecord(rows)
+		if err == nil {
+			e.val = append(e.val, rec)
+		}
+		return err
+	})
+}
+
+// PrepareUpdate stores the response of the record in the key it reserved
+func (e *idempotencyEntity) PrepareUpdate(v interface{}) error {
+	rec, ok := v.(*types.IdempotencyRecord)
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	var contentType interface{}
+	if len(rec.ContentType) > 0 {
+		contentType = rec.ContentType
+	}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "UPDATE %s SET %s=$1, %s=$2, %s=$3 WHERE %s=$4 AND %s=$5 RETURNING %s;",
+		idempotencyKeysTable, colStatus, colContentType, colBody, colKey, colFingerprint, idempotencyCols)
+	e.qa = []interface{}{rec.Status, contentType, rec.Body, rec.Key, rec.Fingerprint}
+	return nil
+}
+
+func (e *idempotencyEntity) Update(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+// PrepareDelete drops the key of the map, or with FilterDue the keys expired
+// by then
+func (e *idempotencyEntity) PrepareDelete(v interface{}) error {
+	var err error
+	e.qa = []interface{}{}
+	e.buff.Reset()
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if k, ok := t[colId]; ok {
+			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s=$1;", idempotencyKeysTable, colKey)
+			e.qa = append(e.qa, k)
+		} else if due, ok := t[types.FilterDue]; ok {
+			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s<=$1;", idempotencyKeysTable, colExpiresAt)
+			e.qa = append(e.qa, due)
+		} else {
+			err = ErrMissingArg
+		}
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	return nil
+}
+
+func (e *idempotencyEntity) Delete(ctx context.Context) error {
+	return e.exec(ctx)
+}
+
+func (e *idempotencyEntity) Value() (interface{}, error) {
+	return e.val, nil
+}
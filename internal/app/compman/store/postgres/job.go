@@ -0,0 +1,251 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/jmakaron/compman/internal/app/compman/types"
+)
+
+const (
+	jobsTable string = "jobs"
+
+	colParams        string = "params"
+	colProgressDone  string = "progress_done"
+	colProgressTotal string = "progress_total"
+	colResult        string = "result"
+	colStartedAt     string = "started_at"
+	colFinishedAt    string = "finished_at"
+	colHeartbeatAt   string = "heartbeat_at"
+	// JobClaim is the key of job updates restricting them to the run of the
+	// worker holding the claim
+	JobClaim string = "claim"
+
+	// JobFrom is the key of job updates listing the statuses the job may be
+	// updated from
+	JobFrom string = "from"
+)
+
+var jobCols = strings.Join([]string{colId, colKind, colParams, colStatus, colProgressDone, colProgressTotal,
+	colResult, colError, colCreatedBy, colCreatedAt, colStartedAt, colFinishedAt, JobClaim}, ", ")
+
+type jobEntity struct {
+	entity
+	val []*types.Job
+}
+
+func (e *jobEntity) reset() {
+	e.buff.Reset()
+	e.qa = []interface{}{}
+	e.val = []*types.Job{}
+	e.actor = 0
+}
+
+func scanJob(row pgx.Row) (*types.Job, error) {
+	var id uuid.UUID
+	var j types.Job
+	var errStr *string
+	var result []byte
+	var claim *uuid.UUID
+	if err := row.Scan(&id, &j.Kind, &j.Params, &j.Status, &j.Progress.Done, &j.Progress.Total,
+		&result, &errStr, &j.CreatedBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt, &claim); err != nil {
+		return nil, err
+	}
+	if claim != nil {
+		j.Claim = claim.String()
+	}
+	if errStr != nil {
+		j.Error = *errStr
+	}
+	if result != nil {
+		j.Result = result
+	}
+	j.ID = id.String()
+	return &j, nil
+}
+
+func (e *jobEntity) queryRow(ctx context.Context) error {
+	return e.entity.queryRow(ctx, func(row pgx.Row) error {
+		j, err := scanJob(row)
+		if err == nil {
+			e.val = []*types.Job{j}
+		}
+		return err
+	})
+}
+
+func (e *jobEntity) PrepareInsert(v interface{}) error {
+	j, ok := v.(*types.Job)
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	e.val = []*types.Job{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, %d, $4, $5, now()) RETURNING %s;",
+		jobsTable, colId, colKind, colParams, colStatus, colProgressTotal, colCreatedBy, colCreatedAt,
+		types.JobQueued, jobCols)
+	e.qa = []interface{}{j.ID, j.Kind, j.Params, j.Progress.Total, nil}
+	e.actor = 5
+	return nil
+}
+
+func (e *jobEntity) Insert(ctx context.Context) error {
+	e.bindActor(ctx)
+	return e.queryRow(ctx)
+}
+
+// PrepareSelect accepts FilterID, FilterStatus, FilterCreatedBy and FilterLimit,
+// jobs are listed newest first
+func (e *jobEntity) PrepareSelect(v interface{}) error {
+	m, err := parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.Job{}
+	e.qa = []interface{}{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s FROM %s", jobCols, jobsTable)
+	conds := []string{}
+	for _, f := range [][2]string{
+		{types.FilterID, colId + "=$%d"},
+		{types.FilterStatus, colStatus + "=$%d"},
+		{types.FilterCreatedBy, colCreatedBy + "=$%d"}} {
+		if v, ok := m[f[0]]; ok {
+			e.qa = append(e.qa, v)
+			conds = append(conds, fmt.Sprintf(f[1], len(e.qa)))
+		}
+	}
+	if len(conds) > 0 {
+		fmt.Fprintf(&e.buff, " WHERE %s", strings.Join(conds, " AND "))
+	}
+	fmt.Fprintf(&e.buff, " ORDER BY %s DESC", colCreatedAt)
+	if v, ok := m[types.FilterLimit]; ok {
+		e.qa = append(e.qa, v)
+		fmt.Fprintf(&e.buff, " LIMIT $%d", len(e.qa))
+	}
+	fmt.Fprintf(&e.buff, ";")
+	return nil
+}
+
+func (e *jobEntity) Select(ctx context.Context) error {
+	e.val = []*types.Job{}
+	return e.query(ctx, func(rows pgx.Rows) error {
+		j, err := scanJob(rows)
+		if err == nil {
+			e.val = append(e.val, j)
+		}
+		return err
+	})
+}
+
+// PrepareUpdate sets the status, progress_done, progress_total, result and
+// error of the map on the job id, if its status is one of JobFrom and, with
+// JobClaim, if it is still held by that claim. Updates renew the heartbeat of
+// running jobs, finished jobs get their finish time.
+func (e *jobEntity) PrepareUpdate(v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	id, ok := m[colId]
+	from, _ := m[JobFrom].([]types.JobStatus)
+	if !ok || len(from) == 0 {
+		e.reset()
+		return ErrMissingArg
+	}
+	e.qa = []interface{}{}
+	sets := []string{}
+	for _, k := range []string{colStatus, colProgressDone, colProgressTotal, colResult, colError} {
+		if v, ok := m[k]; ok {
+			e.qa = append(e.qa, v)
+			sets = append(sets, fmt.Sprintf("%s=$%d", k, len(e.qa)))
+		}
+	}
+	if status, ok := m[colStatus].(types.JobStatus); ok && status.Finished() {
+		sets = append(sets, colFinishedAt+"=now()")
+	}
+	sets = append(sets, colHeartbeatAt+"=now()")
+	statuses := make([]int, len(from))
+	for i, s := range from {
+		statuses[i] = int(s)
+	}
+	e.qa = append(e.qa, id, statuses)
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "UPDATE %s SET %s WHERE %s=$%d AND %s=ANY($%d)",
+		jobsTable, strings.Join(sets, ", "), colId, len(e.qa)-1, colStatus, len(e.qa))
+	if claim, ok := m[JobClaim]; ok {
+		e.qa = append(e.qa, claim)
+		fmt.Fprintf(&e.buff, " AND %s=$%d", JobClaim, len(e.qa))
+	}
+	fmt.Fprintf(&e.buff, " RETURNING %s;", jobCols)
+	return nil
+}
+
+// Update fails with ErrNotFound if the job is missing or not in a JobFrom status
+func (e *jobEntity) Update(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+func (e *jobEntity) PrepareDelete(v interface{}) error {
+	var err error
+	e.qa = []interface{}{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if i, ok := t[colId]; ok {
+			e.buff.Reset()
+			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s=$1 RETURNING %s;", jobsTable, colId, jobCols)
+			e.qa = append(e.qa, i)
+		} else {
+			err = ErrMissingArg
+		}
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	return nil
+}
+
+func (e *jobEntity) Delete(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+// PrepareClaim prepares claiming the oldest queued job, or a running job
+// whose heartbeat is older than the time.Duration lease, abandoned by a
+// stopped worker. The job gets a new claim, so that the updates of a worker
+// still running it fail.
+func (e *jobEntity) PrepareClaim(v interface{}) error {
+	lease, ok := v.(time.Duration)
+	if !ok {
+		e.reset()
+		return ErrUnsupportedType
+	}
+	e.val = []*types.Job{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "UPDATE %s SET %s=%d, %s=COALESCE(%s, now()), %s=now(), %s=$2 WHERE %s=("+
+		"SELECT %s FROM %s WHERE %s=%d OR (%s=%d AND %s<$1) ORDER BY %s LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING %s;",
+		jobsTable, colStatus, types.JobRunning, colStartedAt, colStartedAt, colHeartbeatAt, JobClaim, colId,
+		colId, jobsTable, colStatus, types.JobQueued, colStatus, types.JobRunning, colHeartbeatAt, colCreatedAt,
+		jobCols)
+	e.qa = []interface{}{time.Now().Add(-lease), uuid.NewString()}
+	return nil
+}
+
+// Claim fails with ErrNotFound if there is no job to run
+func (e *jobEntity) Claim(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+func (e *jobEntity) Value() (interface{}, error) {
+	return e.val, nil
+}
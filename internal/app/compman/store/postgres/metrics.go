@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// queryDuration is the latency of the successful queries, by statement
+// (SELECT, INSERT, UPDATE, DELETE, ...)
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "store_query_duration_seconds",
+	Help:    "Latency of the successful store queries.",
+	Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+}, []string{"statement"})
+
+// statement returns the statement of the query qs, e.g. SELECT
+func statement(qs string) string {
+	s, _, _ := strings.Cut(strings.TrimSpace(qs), " ")
+	return strings.ToUpper(s)
+}
+
+func observeQuery(qs string, start time.Time, end time.Time) {
+	queryDuration.WithLabelValues(statement(qs)).Observe(end.Sub(start).Seconds())
+}
+
+var (
+	poolAcquiredConns = prometheus.NewDesc("pgxpool_acquired_conns", "Connections in use.", nil, nil)
+	poolIdleConns     = prometheus.NewDesc("pgxpool_idle_conns", "Idle connections.", nil, nil)
+	poolTotalConns    = prometheus.NewDesc("pgxpool_total_conns", "Connections of the pool.", nil, nil)
+	poolMaxConns      = prometheus.NewDesc("pgxpool_max_conns", "Maximum size of the pool.", nil, nil)
+	poolAcquires      = prometheus.NewDesc("pgxpool_acquires_total", "Connections acquired from the pool.", nil, nil)
+	poolEmptyAcquires = prometheus.NewDesc("pgxpool_empty_acquires_total",
+		"Acquires that waited for a connection, the pool being empty.", nil, nil)
+	poolCanceledAcquires = prometheus.NewDesc("pgxpool_canceled_acquires_total",
+		"Acquires cancelled by their context.", nil, nil)
+	poolAcquireDuration = prometheus.NewDesc("pgxpool_acquire_duration_seconds_total",
+		"Time spent acquiring connections.", nil, nil)
+)
+
+// Describe and Collect export the statistics of the connection pool, the
+// store is registered as a prometheus collector by the service
+func (s *pgStore) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{poolAcquiredConns, poolIdleConns, poolTotalConns, poolMaxConns,
+		poolAcquires, poolEmptyAcquires, poolCanceledAcquires, poolAcquireDuration} {
+		ch <- d
+	}
+}
+
+func (s *pgStore) Collect(ch chan<- prometheus.Metric) {
+	if s.p == nil {
+		return
+	}
+	st := s.p.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(st.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(st.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(st.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(st.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(st.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(st.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquires, prometheus.CounterValue,
+		float64(st.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDuration, prometheus.CounterValue, st.AcquireDuration().Seconds())
+}
@@ -2,10 +2,12 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
 	"github.com/jmakaron/compman/internal/app/compman/store"
 	"github.com/jmakaron/compman/internal/app/compman/types"
 )
@@ -52,14 +54,75 @@ func (s *pgStore) Disconnect() {
 	s.p.Close()
 }
 
+// Ping acquires a connection of the pool and pings the database
+func (s *pgStore) Ping(ctx context.Context) error {
+	if s.p == nil {
+		return store.ErrNotConnected
+	}
+	return s.p.Ping(ctx)
+}
+
 func (s *pgStore) NewEntity(v interface{}) (store.Entity, error) {
+	return s.newEntity(v, nil)
+}
+
+func (s *pgStore) newEntity(v interface{}, tx pgx.Tx) (store.Entity, error) {
 	var err error
 	var e store.Entity
 	switch v.(type) {
 	case *types.Company, types.Company:
-		e = &companyEntity{st: s, buff: strings.Builder{}}
+		e = &companyEntity{entity: entity{st: s, tx: tx}}
+	case *types.ChangeRequest, types.ChangeRequest:
+		e = &changeRequestEntity{entity: entity{st: s, tx: tx}}
+	case *types.ScheduledChange, types.ScheduledChange:
+		e = &scheduledChangeEntity{entity: entity{st: s, tx: tx}}
+	case *types.Job, types.Job:
+		e = &jobEntity{entity: entity{st: s, tx: tx}}
+	case *types.IdempotencyRecord, types.IdempotencyRecord:
+		e = &idempotencyEntity{entity: entity{st: s, tx: tx}}
 	default:
 		err = store.ErrUnsupportedType
 	}
 	return e, err
 }
+
+func (s *pgStore) Begin(ctx context.Context) (store.Tx, error) {
+	if s.p == nil {
+		return nil, store.ErrNotConnected
+	}
+	tx, err := s.p.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pgTx{st: s, tx: tx}, nil
+}
+
+type pgTx struct {
+	st *pgStore
+	tx pgx.Tx
+}
+
+func (t *pgTx) NewEntity(v interface{}) (store.Entity, error) {
+	return t.st.newEntity(v, t.tx)
+}
+
+// TryLock takes the advisory lock of name until the end of the transaction,
+// reporting false if it is held by another transaction
+func (t *pgTx) TryLock(ctx context.Context, name string) (bool, error) {
+	var locked bool
+	err := t.tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock(hashtext($1));", name).Scan(&locked)
+	return locked, err
+}
+
+func (t *pgTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+// Rollback is not cancelled along with ctx, so that the transaction of a
+// cancelled request is still rolled back
+func (t *pgTx) Rollback(ctx context.Context) error {
+	if err := t.tx.Rollback(context.WithoutCancel(ctx)); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+		return err
+	}
+	return nil
+}
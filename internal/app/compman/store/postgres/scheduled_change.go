@@ -0,0 +1,204 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/jmakaron/compman/internal/app/compman/types"
+)
+
+const (
+	scheduledChangesTable string = "scheduled_changes"
+
+	colEffectiveAt string = "effective_at"
+	colAppliedAt   string = "applied_at"
+	colError       string = "error"
+)
+
+var scheduledChangeCols = strings.Join([]string{colId, colCompanyId, colChanges, colEffectiveAt, colStatus,
+	colCreatedBy, colCreatedAt, colAppliedAt, colError}, ", ")
+
+type scheduledChangeEntity struct {
+	entity
+	val []*types.ScheduledChange
+}
+
+func (e *scheduledChangeEntity) reset() {
+	e.buff.Reset()
+	e.qa = []interface{}{}
+	e.val = []*types.ScheduledChange{}
+	e.actor = 0
+}
+
+func scanScheduledChange(row pgx.Row) (*types.ScheduledChange, error) {
+	var id, companyId uuid.UUID
+	var sc types.ScheduledChange
+	var errStr *string
+	if err := row.Scan(&id, &companyId, &sc.Changes, &sc.EffectiveAt, &sc.Status,
+		&sc.CreatedBy, &sc.CreatedAt, &sc.AppliedAt, &errStr); err != nil {
+		return nil, err
+	}
+	if errStr != nil {
+		sc.Error = *errStr
+	}
+	sc.ID = id.String()
+	sc.CompanyID = companyId.String()
+	return &sc, nil
+}
+
+func (e *scheduledChangeEntity) queryRow(ctx context.Context) error {
+	return e.entity.queryRow(ctx, func(row pgx.Row) error {
+		sc, err := scanScheduledChange(row)
+		if err == nil {
+			e.val = []*types.ScheduledChange{sc}
+		}
+		return err
+	})
+}
+
+func (e *scheduledChangeEntity) PrepareInsert(v interface{}) error {
+	var err error
+	var sc types.ScheduledChange
+	switch t := v.(type) {
+	case []byte:
+		err = json.Unmarshal(t, &sc)
+	case *types.ScheduledChange:
+		sc = *t
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.ScheduledChange{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "INSERT INTO %s (%s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, now()) RETURNING %s;",
+		scheduledChangesTable, colId, colCompanyId, colChanges, colEffectiveAt, colCreatedBy, colCreatedAt,
+		scheduledChangeCols)
+	e.qa = []interface{}{sc.ID, sc.CompanyID, sc.Changes, sc.EffectiveAt, nil}
+	e.actor = 5
+	return nil
+}
+
+func (e *scheduledChangeEntity) Insert(ctx context.Context) error {
+	e.bindActor(ctx)
+	return e.queryRow(ctx)
+}
+
+// PrepareSelect accepts FilterDue to select the changes whose effective time
+// is reached, with FilterLock rows locked by other transactions are skipped
+func (e *scheduledChangeEntity) PrepareSelect(v interface{}) error {
+	m, err := parseFilter(v)
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.val = []*types.ScheduledChange{}
+	e.qa = []interface{}{}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "SELECT %s FROM %s", scheduledChangeCols, scheduledChangesTable)
+	conds := []string{}
+	for _, f := range [][2]string{
+		{types.FilterID, colId + "=$%d"},
+		{types.FilterCompanyID, colCompanyId + "=$%d"},
+		{types.FilterStatus, colStatus + "=$%d"},
+		{types.FilterDue, colEffectiveAt + "<=$%d"}} {
+		if v, ok := m[f[0]]; ok {
+			e.qa = append(e.qa, v)
+			conds = append(conds, fmt.Sprintf(f[1], len(e.qa)))
+		}
+	}
+	if len(conds) > 0 {
+		fmt.Fprintf(&e.buff, " WHERE %s", strings.Join(conds, " AND "))
+	}
+	fmt.Fprintf(&e.buff, " ORDER BY %s, %s", colEffectiveAt, colCreatedAt)
+	if v, ok := m[types.FilterLimit]; ok {
+		e.qa = append(e.qa, v)
+		fmt.Fprintf(&e.buff, " LIMIT $%d", len(e.qa))
+	}
+	if lock, _ := m[types.FilterLock].(bool); lock {
+		fmt.Fprintf(&e.buff, " FOR UPDATE SKIP LOCKED")
+	}
+	fmt.Fprintf(&e.buff, ";")
+	return nil
+}
+
+func (e *scheduledChangeEntity) Select(ctx context.Context) error {
+	e.val = []*types.ScheduledChange{}
+	return e.query(ctx, func(rows pgx.Rows) error {
+		sc, err := scanScheduledChange(rows)
+		if err == nil {
+			e.val = append(e.val, sc)
+		}
+		return err
+	})
+}
+
+// PrepareUpdate moves a scheduled change to the status of the map, with the
+// optional error message of failed changes
+func (e *scheduledChangeEntity) PrepareUpdate(v interface{}) error {
+	var err error
+	var id, status, errStr interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		var ok1, ok2 bool
+		id, ok1 = t[colId]
+		status, ok2 = t[colStatus]
+		if !ok1 || !ok2 {
+			err = ErrMissingArg
+		}
+		errStr = t[colError]
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	e.buff.Reset()
+	fmt.Fprintf(&e.buff, "UPDATE %s SET %s=$1, %s=$2, %s=CASE WHEN $1=%d THEN now() END WHERE %s=$3 AND %s=%d RETURNING %s;",
+		scheduledChangesTable, colStatus, colError, colAppliedAt, types.ScheduledChangeApplied,
+		colId, colStatus, types.ScheduledChangeScheduled, scheduledChangeCols)
+	e.qa = []interface{}{status, errStr, id}
+	return nil
+}
+
+func (e *scheduledChangeEntity) Update(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+func (e *scheduledChangeEntity) PrepareDelete(v interface{}) error {
+	var err error
+	e.qa = []interface{}{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if i, ok := t[colId]; ok {
+			e.buff.Reset()
+			fmt.Fprintf(&e.buff, "DELETE FROM %s WHERE %s=$1 RETURNING %s;", scheduledChangesTable, colId, scheduledChangeCols)
+			e.qa = append(e.qa, i)
+		} else {
+			err = ErrMissingArg
+		}
+	default:
+		err = ErrUnsupportedType
+	}
+	if err != nil {
+		e.reset()
+		return err
+	}
+	return nil
+}
+
+func (e *scheduledChangeEntity) Delete(ctx context.Context) error {
+	return e.queryRow(ctx)
+}
+
+func (e *scheduledChangeEntity) Value() (interface{}, error) {
+	return e.val, nil
+}
@@ -11,11 +11,30 @@ var (
 	ErrNotConnected    = errors.New("store not connected")
 )
 
+type ctxKey int
+
+const actorKey ctxKey = iota
+
+// WithActor returns a copy of ctx carrying the user on whose behalf the store
+// is modified, it is recorded in the created_by/updated_by metadata
+func WithActor(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, actorKey, user)
+}
+
+func Actor(ctx context.Context) string {
+	if v, ok := ctx.Value(actorKey).(string); ok {
+		return v
+	}
+	return ""
+}
+
 type QueryLogEntry struct {
 	QStr  string
 	QArgs []interface{}
 	Start time.Time
 	End   time.Time
+	// RequestID is the id of the http request the query was run for
+	RequestID string
 }
 
 type Entity interface {
@@ -31,8 +50,47 @@ type Entity interface {
 	QueryLog() []QueryLogEntry
 }
 
+// Aggregator is optionally implemented by entities whose backend can compute
+// aggregates itself, callers fall back to aggregating the selected values otherwise
+type Aggregator interface {
+	PrepareAggregate(interface{}) error
+	Aggregate(context.Context) (interface{}, error)
+}
+
+// Merger is optionally implemented by entities supporting the merge of
+// duplicate records into a surviving one
+type Merger interface {
+	PrepareMerge(interface{}) error
+	Merge(context.Context) error
+}
+
+// Claimer is optionally implemented by entities whose records are claimed
+// one at a time by workers, e.g. queued jobs
+type Claimer interface {
+	PrepareClaim(interface{}) error
+	Claim(context.Context) error
+}
+
+// Pinger is optionally implemented by stores able to check their connection,
+// e.g. for the readiness probe
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// Tx groups the queries of the entities it creates in a single transaction,
+// Rollback after Commit is a no-op so it can always be deferred
+type Tx interface {
+	NewEntity(interface{}) (Entity, error)
+	// TryLock takes a named lock shared between all store clients, held until
+	// the transaction ends, without waiting for it
+	TryLock(context.Context, string) (bool, error)
+	Commit(context.Context) error
+	Rollback(context.Context) error
+}
+
 type Store interface {
 	Connect(context.Context) error
 	Disconnect()
 	NewEntity(interface{}) (Entity, error)
+	Begin(context.Context) (Tx, error)
 }
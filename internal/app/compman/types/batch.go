@@ -0,0 +1,95 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// operations of a company batch
+const (
+	BatchCreate = "create"
+	BatchPatch  = "patch"
+	BatchDelete = "delete"
+)
+
+// MaxBatchOperations limits the operations of a single batch
+const MaxBatchOperations = 1000
+
+// BatchOperation is an operation of a company batch. Company is the company
+// to create, Patch the update of the company ID, a JSON Merge Patch object or
+// a JSON Patch array.
+type BatchOperation struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Company json.RawMessage `json:"company,omitempty"`
+	Patch   json.RawMessage `json:"patch,omitempty"`
+}
+
+// CompanyBatch lists operations applied in order, all in one transaction
+// if Atomic is set
+type CompanyBatch struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+func (b *CompanyBatch) Validate() error {
+	if len(b.Operations) == 0 {
+		return fmt.Errorf("batch without operations")
+	}
+	if len(b.Operations) > MaxBatchOperations {
+		return fmt.Errorf("batch of %d operations, at most %d are allowed", len(b.Operations), MaxBatchOperations)
+	}
+	for i, o := range b.Operations {
+		switch o.Op {
+		case BatchCreate:
+			if len(o.Company) == 0 {
+				return fmt.Errorf("operation %d creates no company", i)
+			}
+		case BatchPatch:
+			if len(o.ID) == 0 || len(o.Patch) == 0 {
+				return fmt.Errorf("operation %d patches without id or patch", i)
+			}
+		case BatchDelete:
+			if len(o.ID) == 0 {
+				return fmt.Errorf("operation %d deletes without id", i)
+			}
+		default:
+			return fmt.Errorf("operation %d is unknown '%s'", i, o.Op)
+		}
+	}
+	return nil
+}
+
+// PatchMediaType returns the media type of the patch of the operation, JSON
+// Patch for arrays and JSON Merge Patch otherwise
+func (o *BatchOperation) PatchMediaType() string {
+	for _, c := range o.Patch {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return MediaTypeJSONPatch
+		}
+		break
+	}
+	return MediaTypeMergePatch
+}
+
+// BatchResult reports the outcome of a batch operation, with the HTTP status
+// the operation would get on its own endpoint
+type BatchResult struct {
+	Op              string                `json:"op"`
+	ID              string                `json:"id,omitempty"`
+	Status          int                   `json:"status"`
+	Company         *Company              `json:"company,omitempty"`
+	ChangeRequest   *ChangeRequest        `json:"change_request,omitempty"`
+	ScheduledChange *ScheduledChange      `json:"scheduled_change,omitempty"`
+	Candidates      []*DuplicateCandidate `json:"candidates,omitempty"`
+	Error           string                `json:"error,omitempty"`
+	Errors          []FieldError          `json:"errors,omitempty"`
+}
+
+type CompanyBatchResult struct {
+	Atomic  bool           `json:"atomic"`
+	Results []*BatchResult `json:"results"`
+}
@@ -0,0 +1,47 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompanyBatchValidate(t *testing.T) {
+	tests := []struct {
+		ops   string
+		valid bool
+	}{
+		{`[]`, false},
+		{`[{"op":"create","company":{"name":"acme"}}]`, true},
+		{`[{"op":"create"}]`, false},
+		{`[{"op":"patch","id":"1","patch":{"name":"acme"}}]`, true},
+		{`[{"op":"patch","patch":{"name":"acme"}}]`, false},
+		{`[{"op":"delete","id":"1"},{"op":"delete"}]`, false},
+		{`[{"op":"upsert","id":"1"}]`, false},
+	}
+	for i, tc := range tests {
+		var b CompanyBatch
+		if err := json.Unmarshal([]byte(tc.ops), &b.Operations); err != nil {
+			t.Fatalf("case %d, %+v", i, err)
+		}
+		if err := b.Validate(); (err == nil) != tc.valid {
+			t.Errorf("case %d, expected valid %v, got %v", i, tc.valid, err)
+		}
+	}
+	b := CompanyBatch{Operations: make([]BatchOperation, MaxBatchOperations+1)}
+	if err := b.Validate(); err == nil {
+		t.Errorf("batch of %d operations accepted", len(b.Operations))
+	}
+}
+
+func TestBatchPatchMediaType(t *testing.T) {
+	for patch, expected := range map[string]string{
+		`{"name":"acme"}`:                          MediaTypeMergePatch,
+		` [{"op":"remove","path":"/description"}]`: MediaTypeJSONPatch,
+		`null`: MediaTypeMergePatch,
+	} {
+		o := BatchOperation{Op: BatchPatch, Patch: json.RawMessage(patch)}
+		if mt := o.PatchMediaType(); mt != expected {
+			t.Errorf("%s, expected %s, got %s", patch, expected, mt)
+		}
+	}
+}
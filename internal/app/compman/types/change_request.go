@@ -0,0 +1,86 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type ChangeRequestStatus int
+
+const (
+	ChangeRequestPending ChangeRequestStatus = iota
+	ChangeRequestApproved
+	ChangeRequestRejected
+)
+
+func (s ChangeRequestStatus) String() string {
+	var r string
+	switch s {
+	case ChangeRequestPending:
+		r = "pending"
+	case ChangeRequestApproved:
+		r = "approved"
+	case ChangeRequestRejected:
+		r = "rejected"
+	default:
+		r = ""
+	}
+	return r
+}
+
+func ParseChangeRequestStatus(str string) ChangeRequestStatus {
+	var r ChangeRequestStatus
+	switch str {
+	case "pending":
+		r = ChangeRequestPending
+	case "approved":
+		r = ChangeRequestApproved
+	case "rejected":
+		r = ChangeRequestRejected
+	default:
+		r = -1
+	}
+	return r
+}
+
+func (s ChangeRequestStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *ChangeRequestStatus) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = ParseChangeRequestStatus(str)
+	return nil
+}
+
+const (
+	ChangeKindUpdate = "update"
+	ChangeKindDelete = "delete"
+)
+
+// ChangeRequest is a sensitive company change waiting for the approval of a
+// user other than the one proposing it
+type ChangeRequest struct {
+	ID         string                 `json:"id"`
+	CompanyID  string                 `json:"company_id"`
+	Kind       string                 `json:"kind"`
+	Changes    map[string]interface{} `json:"changes,omitempty"`
+	Status     ChangeRequestStatus    `json:"status"`
+	ProposedBy string                 `json:"proposed_by"`
+	ProposedAt time.Time              `json:"proposed_at"`
+	DecidedBy  string                 `json:"decided_by,omitempty"`
+	DecidedAt  *time.Time             `json:"decided_at,omitempty"`
+}
+
+// RequiresApproval reports whether a change of the given kind needs a second
+// user's approval, changes is the patch document of updates
+func RequiresApproval(kind string, changes map[string]interface{}) bool {
+	if kind == ChangeKindDelete {
+		return true
+	}
+	_, ok := changes["type"]
+	return ok
+}
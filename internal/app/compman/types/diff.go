@@ -0,0 +1,56 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// CompanyDiff compares the state of a company at two points in time, From or
+// To are nil when the company did not exist at that point
+type CompanyDiff struct {
+	From    *Company               `json:"from"`
+	To      *Company               `json:"to"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+func companyFields(c *Company) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if c == nil {
+		return m, nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// DiffCompanies lists the JSON fields whose value differs between from and to
+func DiffCompanies(from, to *Company) (*CompanyDiff, error) {
+	mf, err := companyFields(from)
+	if err != nil {
+		return nil, err
+	}
+	mt, err := companyFields(to)
+	if err != nil {
+		return nil, err
+	}
+	d := &CompanyDiff{From: from, To: to, Changes: map[string]FieldChange{}}
+	for k, v := range mf {
+		if !reflect.DeepEqual(v, mt[k]) {
+			d.Changes[k] = FieldChange{From: v, To: mt[k]}
+		}
+	}
+	for k, v := range mt {
+		if _, ok := mf[k]; !ok {
+			d.Changes[k] = FieldChange{To: v}
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,135 @@
+package types
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DuplicateThreshold is the minimum name similarity of likely duplicates
+const DuplicateThreshold = 0.8
+
+const (
+	// DuplicateCandidates is the number of companies with the closest names
+	// compared by the duplicate check
+	DuplicateCandidates = 50
+	// DuplicateClusterCandidates is the number of companies with a similar
+	// name grouped in clusters
+	DuplicateClusterCandidates = 1000
+)
+
+// legalSuffixes are dropped from the end of normalised names
+var legalSuffixes = map[string]struct{}{
+	"ltd": {}, "limited": {}, "llc": {}, "llp": {}, "plc": {}, "inc": {}, "incorporated": {},
+	"corp": {}, "corporation": {}, "co": {}, "company": {}, "gmbh": {}, "ag": {}, "kg": {},
+	"sa": {}, "sarl": {}, "srl": {}, "spa": {}, "bv": {}, "nv": {}, "oy": {}, "ab": {}, "as": {},
+}
+
+// NormalizeName lower-cases the company name, replaces punctuation by spaces
+// and drops trailing legal suffixes, e.g. "ACME, Ltd." becomes "acme"
+func NormalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	// a name made of a suffix only is kept as is
+	for len(words) > 1 {
+		if _, ok := legalSuffixes[words[len(words)-1]]; !ok {
+			break
+		}
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// NameSimilarity scores the similarity of two company names between 0 and 1,
+// from the edit distance of the normalised names
+func NameSimilarity(a, b string) float64 {
+	ra, rb := []rune(NormalizeName(a)), []rune(NormalizeName(b))
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+type DuplicateCandidate struct {
+	*Company
+	Score float64 `json:"score"`
+}
+
+// FindDuplicates returns the companies whose name is similar to name, from
+// the most similar
+func FindDuplicates(name string, companies []*Company) []*DuplicateCandidate {
+	rv := []*DuplicateCandidate{}
+	for _, c := range companies {
+		if score := NameSimilarity(name, c.Name); score >= DuplicateThreshold {
+			rv = append(rv, &DuplicateCandidate{Company: c, Score: score})
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Score > rv[j].Score
+	})
+	return rv
+}
+
+// DuplicateClusters groups the companies linked by similar names, clusters
+// of a single company are left out
+func DuplicateClusters(companies []*Company) [][]*Company {
+	parent := make([]int, len(companies))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range companies {
+		for j := i + 1; j < len(companies); j++ {
+			if NameSimilarity(companies[i].Name, companies[j].Name) >= DuplicateThreshold {
+				parent[root(j)] = root(i)
+			}
+		}
+	}
+	groups := map[int][]*Company{}
+	order := []int{}
+	for i, c := range companies {
+		r := root(i)
+		if _, ok := groups[r]; !ok {
+			order = append(order, r)
+		}
+		groups[r] = append(groups[r], c)
+	}
+	rv := [][]*Company{}
+	for _, r := range order {
+		if len(groups[r]) > 1 {
+			rv = append(rv, groups[r])
+		}
+	}
+	return rv
+}
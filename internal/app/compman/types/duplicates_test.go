@@ -0,0 +1,43 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"ACME, Ltd.":          "acme",
+		"Acme GmbH & Co. KG":  "acme",
+		"acme-widgets inc":    "acme widgets",
+		"  The   Acme Corp  ": "the acme",
+		"Ltd":                 "ltd",
+	} {
+		if got := NormalizeName(name); got != expected {
+			t.Errorf("NormalizeName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	companies := []*Company{
+		{ID: "1", Name: "Acme Ltd"},
+		{ID: "2", Name: "Globex"},
+		{ID: "3", Name: "ACME Inc."},
+		{ID: "4", Name: "Globex Corp"},
+		{ID: "5", Name: "Initech"},
+		{ID: "6", Name: "Acmee"},
+	}
+	expected := [][]*Company{
+		{companies[0], companies[2], companies[5]},
+		{companies[1], companies[3]},
+	}
+	if diff := deep.Equal(DuplicateClusters(companies), expected); diff != nil {
+		t.Error(diff)
+	}
+	candidates := FindDuplicates("acme", companies)
+	if len(candidates) != 3 || candidates[0].Score != 1 || candidates[2].ID != "6" {
+		t.Errorf("unexpected candidates %+v", candidates)
+	}
+}
@@ -0,0 +1,42 @@
+package types
+
+// keys of the company filter passed to store entities on select, companies
+// merged into another one are only selected by FilterID
+const (
+	FilterID           = "id"
+	FilterName         = "name"
+	FilterType         = "type"
+	FilterState        = "state"
+	FilterRegistered   = "registered"
+	FilterMinEmployees = "min_employees"
+	FilterMaxEmployees = "max_employees"
+	FilterCreatedSince = "created_since"
+	FilterUpdatedSince = "updated_since"
+	FilterCreatedBy    = "created_by"
+	FilterUpdatedBy    = "updated_by"
+	FilterSort         = "sort"
+	FilterAsOf         = "as_of"
+	FilterIDs          = "ids"
+	// FilterSimilarTo selects the companies with the names closest to the
+	// given one, at most FilterLimit or DuplicateCandidates
+	FilterSimilarTo = "similar_to"
+	// FilterHasSimilar selects the companies with a similar name, at most
+	// FilterLimit or DuplicateClusterCandidates
+	FilterHasSimilar = "has_similar"
+
+	FilterLEI             = "lei"
+	FilterVAT             = "vat"
+	FilterRegistryCountry = "registry_country"
+	FilterRegistryNumber  = "registry_number"
+)
+
+// keys of the change request and scheduled change filters
+const (
+	FilterCompanyID = "company_id"
+	FilterStatus    = "status"
+	FilterDue       = "due"
+	FilterLimit     = "limit"
+)
+
+// FilterLock locks the selected rows until the end of the enclosing transaction
+const FilterLock = "lock"
@@ -0,0 +1,14 @@
+package types
+
+import "time"
+
+// IdempotencyRecord is the response stored for an Idempotency-Key until it
+// expires, Status is 0 while the request holding the key is handled
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
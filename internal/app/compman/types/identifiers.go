@@ -0,0 +1,142 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// identifier schemes of GET /company/by-identifier/{scheme}/{value}
+const (
+	SchemeLEI      = "lei"
+	SchemeVAT      = "vat"
+	SchemeRegistry = "registry"
+)
+
+var (
+	ErrInvalidIdentifier = errors.New("invalid identifier")
+
+	leiFormat      = regexp.MustCompile(`^[A-Z0-9]{18}[0-9]{2}$`)
+	countryFormat  = regexp.MustCompile(`^[A-Z]{2}$`)
+	registryFormat = regexp.MustCompile(`^[A-Z0-9][A-Z0-9./-]{0,63}$`)
+	// vatFormats holds the format of the EU VAT numbers per country prefix,
+	// Greece uses EL and Northern Ireland XI
+	vatFormats = map[string]*regexp.Regexp{
+		"AT": regexp.MustCompile(`^U[0-9]{8}$`),
+		"BE": regexp.MustCompile(`^[01][0-9]{9}$`),
+		"BG": regexp.MustCompile(`^[0-9]{9,10}$`),
+		"CY": regexp.MustCompile(`^[0-9]{8}[A-Z]$`),
+		"CZ": regexp.MustCompile(`^[0-9]{8,10}$`),
+		"DE": regexp.MustCompile(`^[0-9]{9}$`),
+		"DK": regexp.MustCompile(`^[0-9]{8}$`),
+		"EE": regexp.MustCompile(`^[0-9]{9}$`),
+		"EL": regexp.MustCompile(`^[0-9]{9}$`),
+		"ES": regexp.MustCompile(`^[A-Z0-9][0-9]{7}[A-Z0-9]$`),
+		"FI": regexp.MustCompile(`^[0-9]{8}$`),
+		"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}[0-9]{9}$`),
+		"HR": regexp.MustCompile(`^[0-9]{11}$`),
+		"HU": regexp.MustCompile(`^[0-9]{8}$`),
+		"IE": regexp.MustCompile(`^([0-9]{7}[A-W][A-I]?|[0-9][A-Z+*][0-9]{5}[A-W])$`),
+		"IT": regexp.MustCompile(`^[0-9]{11}$`),
+		"LT": regexp.MustCompile(`^([0-9]{9}|[0-9]{12})$`),
+		"LU": regexp.MustCompile(`^[0-9]{8}$`),
+		"LV": regexp.MustCompile(`^[0-9]{11}$`),
+		"MT": regexp.MustCompile(`^[0-9]{8}$`),
+		"NL": regexp.MustCompile(`^[0-9]{9}B[0-9]{2}$`),
+		"PL": regexp.MustCompile(`^[0-9]{10}$`),
+		"PT": regexp.MustCompile(`^[0-9]{9}$`),
+		"RO": regexp.MustCompile(`^[0-9]{2,10}$`),
+		"SE": regexp.MustCompile(`^[0-9]{10}01$`),
+		"SI": regexp.MustCompile(`^[0-9]{8}$`),
+		"SK": regexp.MustCompile(`^[0-9]{10}$`),
+		"XI": regexp.MustCompile(`^([0-9]{9}|[0-9]{12}|GD[0-4][0-9]{2}|HA[5-9][0-9]{2})$`),
+	}
+)
+
+// compact upper-cases the identifier and drops the separators commonly
+// written in it
+func compact(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(s)))
+}
+
+// NormalizeLEI validates the ISO 17442 Legal Entity Identifier, whose last two
+// digits are an ISO 7064 mod 97-10 checksum, returning its canonical form
+func NormalizeLEI(s string) (string, error) {
+	lei := compact(s)
+	if !leiFormat.MatchString(lei) {
+		return "", fmt.Errorf("%w, LEI '%s' is not 20 alphanumeric characters", ErrInvalidIdentifier, s)
+	}
+	// letters count as 10 to 35, the resulting number is 1 modulo 97
+	var digits strings.Builder
+	for _, r := range lei {
+		if r >= 'A' {
+			fmt.Fprintf(&digits, "%d", r-'A'+10)
+		} else {
+			digits.WriteRune(r)
+		}
+	}
+	n, _ := new(big.Int).SetString(digits.String(), 10)
+	if n.Mod(n, big.NewInt(97)).Int64() != 1 {
+		return "", fmt.Errorf("%w, LEI '%s' has an invalid checksum", ErrInvalidIdentifier, s)
+	}
+	return lei, nil
+}
+
+// NormalizeVAT validates the format of an EU VAT number against the rules of
+// its country prefix, returning its canonical form
+func NormalizeVAT(s string) (string, error) {
+	vat := compact(s)
+	if len(vat) < 3 {
+		return "", fmt.Errorf("%w, VAT number '%s' is too short", ErrInvalidIdentifier, s)
+	}
+	format, ok := vatFormats[vat[:2]]
+	if !ok {
+		return "", fmt.Errorf("%w, VAT number '%s' has no EU country prefix", ErrInvalidIdentifier, s)
+	}
+	if !format.MatchString(vat[2:]) {
+		return "", fmt.Errorf("%w, VAT number '%s' does not match the %s format", ErrInvalidIdentifier, s, vat[:2])
+	}
+	return vat, nil
+}
+
+// NormalizeRegistry validates a national registry number and the ISO 3166
+// alpha-2 code of the country issuing it, returning their canonical form
+func NormalizeRegistry(country, number string) (string, string, error) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if !countryFormat.MatchString(country) {
+		return "", "", fmt.Errorf("%w, registry country '%s' is not an ISO 3166 alpha-2 code", ErrInvalidIdentifier, country)
+	}
+	number = strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(number)), " ", "")
+	if !registryFormat.MatchString(number) {
+		return "", "", fmt.Errorf("%w, registry number '%s'", ErrInvalidIdentifier, number)
+	}
+	return country, number, nil
+}
+
+// IdentifierFilter returns the company filter selecting the company with
+// the identifier value of scheme, registry values are written <country>:<number>
+func IdentifierFilter(scheme, value string) (map[string]interface{}, error) {
+	switch scheme {
+	case SchemeLEI:
+		lei, err := NormalizeLEI(value)
+		return map[string]interface{}{FilterLEI: lei}, err
+	case SchemeVAT:
+		vat, err := NormalizeVAT(value)
+		return map[string]interface{}{FilterVAT: vat}, err
+	case SchemeRegistry:
+		country, number, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w, registry identifier '%s' is not <country>:<number>", ErrInvalidIdentifier, value)
+		}
+		country, number, err := NormalizeRegistry(country, number)
+		return map[string]interface{}{FilterRegistryCountry: country, FilterRegistryNumber: number}, err
+	}
+	return nil, fmt.Errorf("%w, unknown scheme '%s'", ErrInvalidIdentifier, scheme)
+}
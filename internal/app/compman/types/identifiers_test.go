@@ -0,0 +1,53 @@
+package types
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeLEI(t *testing.T) {
+	for in, expected := range map[string]string{
+		"5493001KJTIIGC8Y1R12":     "5493001KJTIIGC8Y1R12",
+		"5493 001k jtii gc8y 1r12": "5493001KJTIIGC8Y1R12",
+		"7ZW8QJWVPR4P1J1KQY45":     "7ZW8QJWVPR4P1J1KQY45",
+		"5493001KJTIIGC8Y1R13":     "",
+		"5493001KJTIIGC8Y1R1":      "",
+		"5493001KJTIIGC8Y1RAB":     "",
+	} {
+		lei, err := NormalizeLEI(in)
+		if len(expected) == 0 {
+			if !errors.Is(err, ErrInvalidIdentifier) {
+				t.Errorf("NormalizeLEI(%q) expected to fail, got %q %v", in, lei, err)
+			}
+		} else if err != nil || lei != expected {
+			t.Errorf("NormalizeLEI(%q) = %q %v, expected %q", in, lei, err, expected)
+		}
+	}
+}
+
+func TestNormalizeVAT(t *testing.T) {
+	for in, valid := range map[string]bool{
+		"DE123456789":    true,
+		"de 123.456.789": true,
+		"ATU12345678":    true,
+		"NL123456789B01": true,
+		"EL123456789":    true,
+		"FR12345678901":  true,
+		"IE1234567WA":    true,
+		"GR123456789":    false,
+		"DE12345678":     false,
+		"NL123456789X01": false,
+		"US123456789":    false,
+		"AT12345678":     false,
+		"XIGD123":        true,
+		"SE123456789001": true,
+		"SE123456789002": false,
+		"BE0123456789":   true,
+		"BE2123456789":   false,
+		"":               false,
+	} {
+		if _, err := NormalizeVAT(in); (err == nil) != valid {
+			t.Errorf("NormalizeVAT(%q) valid %v, got %v", in, valid, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type JobStatus int
+
+const (
+	JobQueued JobStatus = iota
+	JobRunning
+	JobSucceeded
+	JobFailed
+	JobCancelled
+)
+
+func (s JobStatus) String() string {
+	var r string
+	switch s {
+	case JobQueued:
+		r = "queued"
+	case JobRunning:
+		r = "running"
+	case JobSucceeded:
+		r = "succeeded"
+	case JobFailed:
+		r = "failed"
+	case JobCancelled:
+		r = "cancelled"
+	default:
+		r = ""
+	}
+	return r
+}
+
+func ParseJobStatus(str string) JobStatus {
+	var r JobStatus
+	switch str {
+	case "queued":
+		r = JobQueued
+	case "running":
+		r = JobRunning
+	case "succeeded":
+		r = JobSucceeded
+	case "failed":
+		r = JobFailed
+	case "cancelled":
+		r = JobCancelled
+	default:
+		r = -1
+	}
+	return r
+}
+
+func (s JobStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *JobStatus) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = ParseJobStatus(str)
+	return nil
+}
+
+// Finished reports whether the job has ended, it is not run any more
+func (s JobStatus) Finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// kinds of jobs
+const (
+	// JobImport creates the companies of the params
+	JobImport = "import"
+	// JobExport stores the companies matching the query of the params as the result
+	JobExport = "export"
+	// JobRepublish publishes a republish event for the companies matching the
+	// query of the params
+	JobRepublish = "republish"
+)
+
+// JobParams are the parameters of a job, Companies for imports and Query,
+// list query parameters, for exports and republishing
+type JobParams struct {
+	Companies []json.RawMessage `json:"companies,omitempty"`
+	Force     bool              `json:"force,omitempty"`
+	Query     string            `json:"query,omitempty"`
+}
+
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Job is a long-running operation run by the workers of the service, the
+// result of finished jobs is kept at ResultLocation
+type Job struct {
+	ID             string          `json:"id"`
+	Kind           string          `json:"kind"`
+	Params         JobParams       `json:"params"`
+	Status         JobStatus       `json:"status"`
+	Progress       JobProgress     `json:"progress"`
+	Result         json.RawMessage `json:"-"`
+	ResultLocation string          `json:"result_location,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	CreatedBy      string          `json:"created_by"`
+	CreatedAt      time.Time       `json:"created_at"`
+	StartedAt      *time.Time      `json:"started_at,omitempty"`
+	FinishedAt     *time.Time      `json:"finished_at,omitempty"`
+	// Claim identifies the run of the worker holding the running job, it
+	// changes when the job is claimed again
+	Claim string `json:"-"`
+}
+
+func (j *Job) Validate() error {
+	switch j.Kind {
+	case JobImport:
+		if len(j.Params.Companies) == 0 {
+			return fmt.Errorf("import job without companies")
+		}
+	case JobExport, JobRepublish:
+		if len(j.Params.Companies) > 0 {
+			return fmt.Errorf("%s job with companies", j.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown job kind '%s'", j.Kind)
+	}
+	return nil
+}
+
+// JobImportResult is the result of import jobs, with the result of the
+// create operation of every company
+type JobImportResult struct {
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Results []*BatchResult `json:"results"`
+}
+
+// JobRepublishResult is the result of republish jobs
+type JobRepublishResult struct {
+	Published int `json:"published"`
+}
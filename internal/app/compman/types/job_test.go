@@ -0,0 +1,41 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJobValidate(t *testing.T) {
+	company := json.RawMessage(`{"name":"acme"}`)
+	tests := []struct {
+		job   Job
+		valid bool
+	}{
+		{Job{Kind: JobImport, Params: JobParams{Companies: []json.RawMessage{company}}}, true},
+		{Job{Kind: JobImport}, false},
+		{Job{Kind: JobExport, Params: JobParams{Query: "type=corporation"}}, true},
+		{Job{Kind: JobRepublish, Params: JobParams{Companies: []json.RawMessage{company}}}, false},
+		{Job{Kind: "purge"}, false},
+	}
+	for i, tc := range tests {
+		if err := tc.job.Validate(); (err == nil) != tc.valid {
+			t.Errorf("case %d, expected valid %v, got %v", i, tc.valid, err)
+		}
+	}
+}
+
+func TestJobStatusJSON(t *testing.T) {
+	for _, s := range []JobStatus{JobQueued, JobRunning, JobSucceeded, JobFailed, JobCancelled} {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rv JobStatus
+		if err = json.Unmarshal(b, &rv); err != nil || rv != s {
+			t.Errorf("%s, got %v %v", b, rv, err)
+		}
+	}
+	if !JobCancelled.Finished() || JobRunning.Finished() {
+		t.Errorf("unexpected finished statuses")
+	}
+}
@@ -9,14 +9,39 @@ const (
 	opInsert = "insert"
 	opUpdate = "update"
 	opDelete = "delete"
+	// OpRepublish re-publishes the current state of a company
+	OpRepublish = "republish"
+
+	OpChangeRequestCreated  = "change-request-created"
+	OpChangeRequestApproved = "change-request-approved"
+	OpChangeRequestRejected = "change-request-rejected"
+
+	OpMerge = "merge"
 )
 
 var (
 	ErrUnsupportedOperation = errors.New("unsupported operation")
 	cmdTopic                = "commandTopic"
-	eventTopic              = map[string]string{opInsert: cmdTopic, opUpdate: cmdTopic, opDelete: cmdTopic}
+	eventTopic              = map[string]string{
+		opInsert:    cmdTopic,
+		opUpdate:    cmdTopic,
+		opDelete:    cmdTopic,
+		OpRepublish: cmdTopic,
+	}
+	changeRequestTopic = map[string]string{
+		OpChangeRequestCreated:  cmdTopic,
+		OpChangeRequestApproved: cmdTopic,
+		OpChangeRequestRejected: cmdTopic,
+	}
 )
 
+func init() {
+	// every lifecycle transition is published as its own operation
+	for name := range Transitions {
+		eventTopic[name] = cmdTopic
+	}
+}
+
 type KafkaCompanyEvent struct {
 	topic *string
 	*Company
@@ -37,12 +62,74 @@ func (e *KafkaCompanyEvent) Value() []byte {
 }
 
 func NewKafkaCompanyEvent(c *Company, op string) (*KafkaCompanyEvent, error) {
-	if op != opInsert && op != opUpdate && op != opDelete {
+	topic, ok := eventTopic[op]
+	if !ok {
 		return nil, ErrUnsupportedOperation
 	}
-	var topic string
 	rv := KafkaCompanyEvent{Company: c, Op: op}
-	topic = eventTopic[op]
+	rv.topic = &topic
+	return &rv, nil
+}
+
+type KafkaChangeRequestEvent struct {
+	topic *string
+	*ChangeRequest
+	Op string `json:"op"`
+}
+
+func (e *KafkaChangeRequestEvent) Topic() *string {
+	return e.topic
+}
+
+// Key is the company id, so that change requests are ordered with the
+// company events
+func (e *KafkaChangeRequestEvent) Key() []byte {
+	return []byte(e.CompanyID)
+}
+
+func (e *KafkaChangeRequestEvent) Value() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// KafkaMergeEvent reports the companies merged into the survivor, so that
+// consumers can remap their references to the merged ids
+type KafkaMergeEvent struct {
+	topic     *string
+	Survivor  *Company `json:"survivor"`
+	MergedIDs []string `json:"merged_ids"`
+	Op        string   `json:"op"`
+}
+
+func (e *KafkaMergeEvent) Topic() *string {
+	return e.topic
+}
+
+func (e *KafkaMergeEvent) Key() []byte {
+	return []byte(e.Survivor.ID)
+}
+
+func (e *KafkaMergeEvent) Value() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
+func NewKafkaMergeEvent(res *CompanyMergeResult) *KafkaMergeEvent {
+	rv := KafkaMergeEvent{Survivor: res.Survivor, MergedIDs: make([]string, len(res.Merged)), Op: OpMerge}
+	for i, c := range res.Merged {
+		rv.MergedIDs[i] = c.ID
+	}
+	topic := cmdTopic
+	rv.topic = &topic
+	return &rv
+}
+
+func NewKafkaChangeRequestEvent(cr *ChangeRequest, op string) (*KafkaChangeRequestEvent, error) {
+	topic, ok := changeRequestTopic[op]
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+	rv := KafkaChangeRequestEvent{ChangeRequest: cr, Op: op}
 	rv.topic = &topic
 	return &rv, nil
 }
@@ -0,0 +1,146 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+)
+
+type MergeRule string
+
+const (
+	// MergeKeepSurvivor keeps the value of the survivor, the default rule
+	MergeKeepSurvivor MergeRule = "survivor"
+	// MergeNewest takes the value of the most recently updated company
+	MergeNewest MergeRule = "newest"
+	// MergeFirstNonEmpty keeps the survivor value, unless it is empty
+	MergeFirstNonEmpty MergeRule = "first-non-empty"
+	MergeLongest       MergeRule = "longest"
+	MergeMax           MergeRule = "max"
+	MergeMin           MergeRule = "min"
+	MergeSum           MergeRule = "sum"
+)
+
+// mergeFields lists the company fields a merge may resolve and the rules
+// applicable to each of them. Fields whose changes require approval, e.g.
+// type, can not be merged.
+var mergeFields = map[string][]MergeRule{
+	"name":           {MergeKeepSurvivor, MergeNewest, MergeLongest},
+	"description":    {MergeKeepSurvivor, MergeNewest, MergeFirstNonEmpty, MergeLongest},
+	"employee_count": {MergeKeepSurvivor, MergeNewest, MergeMax, MergeMin, MergeSum},
+}
+
+// CompanyMerge requests merging the duplicates into the survivor, Rules maps
+// company fields to the rule resolving their conflicts
+type CompanyMerge struct {
+	SurvivorID   string               `json:"survivor"`
+	DuplicateIDs []string             `json:"duplicates"`
+	Rules        map[string]MergeRule `json:"rules,omitempty"`
+}
+
+func (m *CompanyMerge) Validate() error {
+	if len(m.DuplicateIDs) == 0 {
+		return fmt.Errorf("no duplicates to merge into '%s'", m.SurvivorID)
+	}
+	seen := map[string]struct{}{m.SurvivorID: {}}
+	for _, id := range m.DuplicateIDs {
+		if _, ok := seen[id]; ok {
+			return fmt.Errorf("company '%s' is listed more than once", id)
+		}
+		seen[id] = struct{}{}
+	}
+	for field, rule := range m.Rules {
+		rules, ok := mergeFields[field]
+		if !ok {
+			return fmt.Errorf("field '%s' can not be merged", field)
+		}
+		valid := false
+		for _, r := range rules {
+			valid = valid || r == rule
+		}
+		if !valid {
+			return fmt.Errorf("rule '%s' does not apply to field '%s'", rule, field)
+		}
+	}
+	return nil
+}
+
+// ResolveMerge applies the rules of m to the survivor and its duplicates,
+// returning the update of the survivor fields whose value changes
+func (m *CompanyMerge) ResolveMerge(survivor *Company, duplicates []*Company) map[string]interface{} {
+	// the survivor comes first, then the duplicates from the most recently updated
+	all := append([]*Company{survivor}, duplicates...)
+	sort.SliceStable(all[1:], func(i, j int) bool {
+		return all[1+i].UpdatedAt.After(all[1+j].UpdatedAt)
+	})
+	newest := survivor
+	if all[1].UpdatedAt.After(survivor.UpdatedAt) {
+		newest = all[1]
+	}
+	update := map[string]interface{}{}
+	for field, rule := range m.Rules {
+		switch field {
+		case "name":
+			name := survivor.Name
+			switch rule {
+			case MergeNewest:
+				name = newest.Name
+			case MergeLongest:
+				for _, c := range all {
+					if len(c.Name) > len(name) {
+						name = c.Name
+					}
+				}
+			}
+			if name != survivor.Name {
+				update[field] = name
+			}
+		case "description":
+			desc := survivor.Desc
+			switch rule {
+			case MergeNewest:
+				desc = newest.Desc
+			case MergeFirstNonEmpty:
+				for _, c := range all {
+					if c.Desc != nil && len(*c.Desc) > 0 {
+						desc = c.Desc
+						break
+					}
+				}
+			case MergeLongest:
+				for _, c := range all {
+					if c.Desc != nil && (desc == nil || len(*c.Desc) > len(*desc)) {
+						desc = c.Desc
+					}
+				}
+			}
+			if (desc == nil) != (survivor.Desc == nil) || (desc != nil && *desc != *survivor.Desc) {
+				update[field] = desc
+			}
+		case "employee_count":
+			cnt := survivor.EmployeeCnt
+			switch rule {
+			case MergeNewest:
+				cnt = newest.EmployeeCnt
+			case MergeMax, MergeMin, MergeSum:
+				for _, c := range all[1:] {
+					switch {
+					case rule == MergeSum:
+						cnt += c.EmployeeCnt
+					case rule == MergeMax && c.EmployeeCnt > cnt, rule == MergeMin && c.EmployeeCnt < cnt:
+						cnt = c.EmployeeCnt
+					}
+				}
+			}
+			if cnt != survivor.EmployeeCnt {
+				update[field] = cnt
+			}
+		}
+	}
+	return update
+}
+
+// CompanyMergeResult is the survivor of a merge and the companies merged into it
+type CompanyMergeResult struct {
+	Survivor *Company   `json:"survivor"`
+	Merged   []*Company `json:"merged"`
+}
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestResolveMerge(t *testing.T) {
+	now := time.Now()
+	short, long := "acme", "acme, the company"
+	survivor := &Company{ID: "s", Name: "Acme", EmployeeCnt: 10, CType: CompanyTypeCorporation, UpdatedAt: now.Add(-time.Hour)}
+	duplicates := []*Company{
+		{ID: "d1", Name: "ACME Ltd", Desc: &short, EmployeeCnt: 5, CType: CompanyTypeCorporation, UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "d2", Name: "Acme Inc", Desc: &long, EmployeeCnt: 20, CType: CompanyTypeCooperative, UpdatedAt: now},
+	}
+	tests := []struct {
+		rules    map[string]MergeRule
+		expected map[string]interface{}
+	}{
+		{nil, map[string]interface{}{}},
+		{map[string]MergeRule{"name": MergeKeepSurvivor, "employee_count": MergeMin},
+			map[string]interface{}{"employee_count": 5}},
+		{map[string]MergeRule{"name": MergeLongest, "employee_count": MergeSum},
+			map[string]interface{}{"name": "Acme Inc", "employee_count": 35}},
+		{map[string]MergeRule{"employee_count": MergeMax, "description": MergeFirstNonEmpty},
+			map[string]interface{}{"employee_count": 20, "description": &long}},
+		{map[string]MergeRule{"name": MergeNewest, "description": MergeLongest},
+			map[string]interface{}{"name": "Acme Inc", "description": &long}},
+	}
+	for i, tc := range tests {
+		m := CompanyMerge{SurvivorID: "s", DuplicateIDs: []string{"d1", "d2"}, Rules: tc.rules}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("case %d, %+v", i, err)
+		}
+		if diff := deep.Equal(m.ResolveMerge(survivor, duplicates), tc.expected); diff != nil {
+			t.Errorf("case %d, %v", i, diff)
+		}
+	}
+}
+
+func TestValidateMerge(t *testing.T) {
+	for i, m := range []CompanyMerge{
+		{SurvivorID: "s"},
+		{SurvivorID: "s", DuplicateIDs: []string{"s"}},
+		{SurvivorID: "s", DuplicateIDs: []string{"d", "d"}},
+		{SurvivorID: "s", DuplicateIDs: []string{"d"}, Rules: map[string]MergeRule{"state": MergeNewest}},
+		{SurvivorID: "s", DuplicateIDs: []string{"d"}, Rules: map[string]MergeRule{"type": MergeNewest}},
+		{SurvivorID: "s", DuplicateIDs: []string{"d"}, Rules: map[string]MergeRule{"name": MergeSum}},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d, expected an error", i)
+		}
+	}
+}
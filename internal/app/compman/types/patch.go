@@ -0,0 +1,289 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// media types of the company update documents
+const (
+	MediaTypeJSON       = "application/json"
+	MediaTypeMergePatch = "application/merge-patch+json"
+	MediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch  = errors.New("invalid patch")
+	ErrPatchConflict = errors.New("patch does not apply to the document")
+)
+
+// CompanyDocument returns the JSON document of the company patches apply to
+func CompanyDocument(c *Company) (map[string]interface{}, error) {
+	return companyFields(c)
+}
+
+// MergePatch applies the RFC 7396 merge patch to target, returning the
+// patched document. target is modified.
+func MergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = MergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// PatchOperation is an operation of an RFC 6902 JSON Patch, Value is nil
+// when the member is missing
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (o *PatchOperation) value() (interface{}, error) {
+	if o.Value == nil {
+		return nil, fmt.Errorf("%w, %s operation on '%s' without value", ErrInvalidPatch, o.Op, o.Path)
+	}
+	var v interface{}
+	if err := json.Unmarshal(o.Value, &v); err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrInvalidPatch, err)
+	}
+	return v, nil
+}
+
+// ApplyJSONPatch applies the RFC 6902 operations to doc in order, returning
+// the patched document. doc is modified, it must be decoded JSON.
+func ApplyJSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	for _, o := range ops {
+		path, err := parsePointer(o.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch o.Op {
+		case "add", "replace", "test":
+			var v interface{}
+			if v, err = o.value(); err != nil {
+				return nil, err
+			}
+			switch o.Op {
+			case "add":
+				doc, err = addValue(doc, path, v)
+			case "replace":
+				if len(path) == 0 {
+					doc = v
+				} else if doc, _, err = removeValue(doc, path); err == nil {
+					doc, err = addValue(doc, path, v)
+				}
+			case "test":
+				var cur interface{}
+				if cur, err = getValue(doc, path); err == nil && !reflect.DeepEqual(cur, v) {
+					err = fmt.Errorf("%w, test of '%s' failed", ErrPatchConflict, o.Path)
+				}
+			}
+		case "remove":
+			doc, _, err = removeValue(doc, path)
+		case "move", "copy":
+			var from []string
+			if from, err = parsePointer(o.From); err != nil {
+				return nil, err
+			}
+			var v interface{}
+			if o.Op == "move" {
+				if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+					return nil, fmt.Errorf("%w, '%s' can not be moved into itself", ErrInvalidPatch, o.From)
+				}
+				doc, v, err = removeValue(doc, from)
+			} else if v, err = getValue(doc, from); err == nil {
+				v, err = copyValue(v)
+			}
+			if err == nil {
+				doc, err = addValue(doc, path, v)
+			}
+		default:
+			err = fmt.Errorf("%w, unknown operation '%s'", ErrInvalidPatch, o.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// PatchChanges returns the members of the patched document to whose value
+// differs in the document from, removed members are null
+func PatchChanges(from, to map[string]interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	for k, v := range to {
+		if cur, ok := from[k]; !ok || !reflect.DeepEqual(cur, v) {
+			m[k] = v
+		}
+	}
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			m[k] = nil
+		}
+	}
+	return m
+}
+
+// parsePointer splits the RFC 6901 JSON pointer into its reference tokens
+func parsePointer(p string) ([]string, error) {
+	if len(p) == 0 {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("%w, '%s' is not a JSON pointer", ErrInvalidPatch, p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the array index token, end allows the index past the last element
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w, '%s' is not an array index", ErrInvalidPatch, token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("%w, index %d out of bounds", ErrPatchConflict, i)
+	}
+	return i, nil
+}
+
+// update replaces the value at path by the result of fn, called with the
+// parent container of path and the last token
+func update(doc interface{}, path []string, fn func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch t := doc.(type) {
+	case map[string]interface{}:
+		child, ok := t[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w, member '%s' does not exist", ErrPatchConflict, path[0])
+		}
+		v, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		t[path[0]] = v
+		return t, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(t), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := update(t[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = v
+		return t, nil
+	}
+	return nil, fmt.Errorf("%w, '%s' is not in a container", ErrPatchConflict, path[0])
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch t := doc.(type) {
+		case map[string]interface{}:
+			v, ok := t[token]
+			if !ok {
+				return nil, fmt.Errorf("%w, member '%s' does not exist", ErrPatchConflict, token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(t), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = t[i]
+		default:
+			return nil, fmt.Errorf("%w, '%s' is not in a container", ErrPatchConflict, token)
+		}
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			t[token] = v
+			return t, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(t), true)
+			if err != nil {
+				return nil, err
+			}
+			t = append(t, nil)
+			copy(t[i+1:], t[i:])
+			t[i] = v
+			return t, nil
+		}
+		return nil, fmt.Errorf("%w, '%s' is not in a container", ErrPatchConflict, token)
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w, the document can not be removed", ErrInvalidPatch)
+	}
+	var removed interface{}
+	doc, err := update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			v, ok := t[token]
+			if !ok {
+				return nil, fmt.Errorf("%w, member '%s' does not exist", ErrPatchConflict, token)
+			}
+			removed = v
+			delete(t, token)
+			return t, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(t), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = t[i]
+			return append(t[:i], t[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w, '%s' is not in a container", ErrPatchConflict, token)
+	})
+	return doc, removed, err
+}
+
+func copyValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var rv interface{}
+	err = json.Unmarshal(b, &rv)
+	return rv, err
+}
@@ -0,0 +1,90 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, tc := range [][3]string{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	} {
+		if diff := deep.Equal(MergePatch(decode(t, tc[0]), decode(t, tc[1])), decode(t, tc[2])); diff != nil {
+			t.Errorf("%s merged with %s, %v", tc[0], tc[1], diff)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	for _, tc := range []struct {
+		doc, patch, expected string
+		err                  error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`, nil},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"copy","from":"/a~1b","path":"/m~0n"}]`, `{"a/b":1,"m~n":1}`, nil},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, ErrPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, ErrPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"qux"}]`, ``, ErrPatchConflict},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/01","value":"qux"}]`, ``, ErrInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, ``, ErrInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"inc","path":"/foo"}]`, ``, ErrInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, ``, ErrInvalidPatch},
+	} {
+		var ops []PatchOperation
+		if err := json.Unmarshal([]byte(tc.patch), &ops); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := ApplyJSONPatch(decode(t, tc.doc), ops)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s, expected %v, got %v", tc.patch, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s, %v", tc.patch, err)
+		} else if diff := deep.Equal(doc, decode(t, tc.expected)); diff != nil {
+			t.Errorf("%s, %v", tc.patch, diff)
+		}
+	}
+}
+
+func TestPatchChanges(t *testing.T) {
+	from := decode(t, `{"id":"1","name":"a","description":"d","employee_count":1}`).(map[string]interface{})
+	to := decode(t, `{"id":"1","name":"b","employee_count":1,"lei":"x"}`).(map[string]interface{})
+	expected := map[string]interface{}{"name": "b", "description": nil, "lei": "x"}
+	if diff := deep.Equal(PatchChanges(from, to), expected); diff != nil {
+		t.Error(diff)
+	}
+}
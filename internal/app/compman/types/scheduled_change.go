@@ -0,0 +1,96 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type ScheduledChangeStatus int
+
+const (
+	ScheduledChangeScheduled ScheduledChangeStatus = iota
+	ScheduledChangeApplied
+	ScheduledChangeCancelled
+	ScheduledChangeFailed
+)
+
+func (s ScheduledChangeStatus) String() string {
+	var r string
+	switch s {
+	case ScheduledChangeScheduled:
+		r = "scheduled"
+	case ScheduledChangeApplied:
+		r = "applied"
+	case ScheduledChangeCancelled:
+		r = "cancelled"
+	case ScheduledChangeFailed:
+		r = "failed"
+	default:
+		r = ""
+	}
+	return r
+}
+
+func ParseScheduledChangeStatus(str string) ScheduledChangeStatus {
+	var r ScheduledChangeStatus
+	switch str {
+	case "scheduled":
+		r = ScheduledChangeScheduled
+	case "applied":
+		r = ScheduledChangeApplied
+	case "cancelled":
+		r = ScheduledChangeCancelled
+	case "failed":
+		r = ScheduledChangeFailed
+	default:
+		r = -1
+	}
+	return r
+}
+
+func (s ScheduledChangeStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *ScheduledChangeStatus) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = ParseScheduledChangeStatus(str)
+	return nil
+}
+
+// EffectiveAtKey is the key of the update document holding the time at which
+// the update takes effect
+const EffectiveAtKey = "effective_at"
+
+// ScheduledChange is a company update applied by the scheduler once
+// EffectiveAt is reached
+type ScheduledChange struct {
+	ID          string                 `json:"id"`
+	CompanyID   string                 `json:"company_id"`
+	Changes     map[string]interface{} `json:"changes"`
+	EffectiveAt time.Time              `json:"effective_at"`
+	Status      ScheduledChangeStatus  `json:"status"`
+	CreatedBy   string                 `json:"created_by"`
+	CreatedAt   time.Time              `json:"created_at"`
+	AppliedAt   *time.Time             `json:"applied_at,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// PopEffectiveAt removes the effective_at key from the update document m,
+// returning its value or the zero time if there is none
+func PopEffectiveAt(m map[string]interface{}) (time.Time, error) {
+	v, ok := m[EffectiveAtKey]
+	if !ok {
+		return time.Time{}, nil
+	}
+	delete(m, EffectiveAtKey)
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid %s '%v'", EffectiveAtKey, v)
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,118 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var (
+	ErrUnknownTransition = errors.New("unknown transition")
+	ErrInvalidTransition = errors.New("invalid transition")
+)
+
+type CompanyState int
+
+const (
+	CompanyStateDraft CompanyState = iota
+	CompanyStatePendingRegistration
+	CompanyStateActive
+	CompanyStateSuspended
+	CompanyStateDissolved
+)
+
+func (s CompanyState) String() string {
+	var r string
+	switch s {
+	case CompanyStateDraft:
+		r = "draft"
+	case CompanyStatePendingRegistration:
+		r = "pending-registration"
+	case CompanyStateActive:
+		r = "active"
+	case CompanyStateSuspended:
+		r = "suspended"
+	case CompanyStateDissolved:
+		r = "dissolved"
+	default:
+		r = ""
+	}
+	return r
+}
+
+func ParseCompanyState(str string) CompanyState {
+	var r CompanyState
+	switch str {
+	case "draft":
+		r = CompanyStateDraft
+	case "pending-registration":
+		r = CompanyStatePendingRegistration
+	case "active":
+		r = CompanyStateActive
+	case "suspended":
+		r = CompanyStateSuspended
+	case "dissolved":
+		r = CompanyStateDissolved
+	default:
+		r = -1
+	}
+	return r
+}
+
+func (s CompanyState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *CompanyState) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*s = ParseCompanyState(str)
+	return nil
+}
+
+// Registered reports whether a company in this state counts as registered
+func (s CompanyState) Registered() bool {
+	return s == CompanyStateActive || s == CompanyStateSuspended
+}
+
+// RegisteredStates lists the states for which Registered is true
+var RegisteredStates = []CompanyState{CompanyStateActive, CompanyStateSuspended}
+
+const (
+	TransitionSubmit    = "submit"
+	TransitionActivate  = "activate"
+	TransitionReject    = "reject"
+	TransitionSuspend   = "suspend"
+	TransitionReinstate = "reinstate"
+	TransitionDissolve  = "dissolve"
+)
+
+type Transition struct {
+	From []CompanyState
+	To   CompanyState
+}
+
+// Transitions is the lifecycle transition table, keyed by transition name
+var Transitions = map[string]Transition{
+	TransitionSubmit:    {From: []CompanyState{CompanyStateDraft}, To: CompanyStatePendingRegistration},
+	TransitionActivate:  {From: []CompanyState{CompanyStatePendingRegistration}, To: CompanyStateActive},
+	TransitionReject:    {From: []CompanyState{CompanyStatePendingRegistration}, To: CompanyStateDraft},
+	TransitionSuspend:   {From: []CompanyState{CompanyStateActive}, To: CompanyStateSuspended},
+	TransitionReinstate: {From: []CompanyState{CompanyStateSuspended}, To: CompanyStateActive},
+	TransitionDissolve:  {From: []CompanyState{CompanyStateActive, CompanyStateSuspended}, To: CompanyStateDissolved},
+}
+
+// Apply returns the state reached by the named transition from s
+func (s CompanyState) Apply(transition string) (CompanyState, error) {
+	t, ok := Transitions[transition]
+	if !ok {
+		return s, ErrUnknownTransition
+	}
+	for _, from := range t.From {
+		if from == s {
+			return t.To, nil
+		}
+	}
+	return s, ErrInvalidTransition
+}
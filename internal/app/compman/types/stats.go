@@ -0,0 +1,92 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Percentiles reported for employee_count, expressed as fractions
+var StatsPercentiles = []float64{0.25, 0.5, 0.75, 0.9, 0.99}
+
+type EmployeeStats struct {
+	Sum         int64              `json:"sum"`
+	Avg         float64            `json:"avg"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+type CompanyStats struct {
+	Total        int            `json:"total"`
+	ByType       map[string]int `json:"by_type"`
+	ByState      map[string]int `json:"by_state"`
+	Registered   int            `json:"registered"`
+	Unregistered int            `json:"unregistered"`
+	Employees    EmployeeStats  `json:"employee_count"`
+}
+
+func NewCompanyStats() *CompanyStats {
+	s := &CompanyStats{
+		ByType:    map[string]int{},
+		ByState:   map[string]int{},
+		Employees: EmployeeStats{Percentiles: map[string]float64{}},
+	}
+	for t := CompanyTypeCorporation; t <= CompanyTypeSoleProprietorship; t++ {
+		s.ByType[t.String()] = 0
+	}
+	for st := CompanyStateDraft; st <= CompanyStateDissolved; st++ {
+		s.ByState[st.String()] = 0
+	}
+	for _, p := range StatsPercentiles {
+		s.Employees.Percentiles[PercentileLabel(p)] = 0
+	}
+	return s
+}
+
+// Add accounts a group of companies sharing type and state, used when the
+// grouping is done by the store backend
+func (s *CompanyStats) Add(ctype CompanyType, state CompanyState, count int, employees int64) {
+	s.Total += count
+	s.ByType[ctype.String()] += count
+	s.ByState[state.String()] += count
+	if state.Registered() {
+		s.Registered += count
+	} else {
+		s.Unregistered += count
+	}
+	s.Employees.Sum += employees
+	if s.Total > 0 {
+		s.Employees.Avg = float64(s.Employees.Sum) / float64(s.Total)
+	}
+}
+
+func PercentileLabel(p float64) string {
+	return fmt.Sprintf("p%g", p*100)
+}
+
+// Percentile computes the p-th percentile of the sorted values, interpolating
+// linearly between the closest ranks (same as postgres percentile_cont)
+func Percentile(sorted []int, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	lo, hi := int(math.Floor(pos)), int(math.Ceil(pos))
+	frac := pos - float64(lo)
+	return float64(sorted[lo]) + float64(sorted[hi]-sorted[lo])*frac
+}
+
+// AggregateCompanies computes the statistics in process, for store backends
+// that can not aggregate on their own
+func AggregateCompanies(l []*Company) *CompanyStats {
+	s := NewCompanyStats()
+	cnts := make([]int, 0, len(l))
+	for _, c := range l {
+		s.Add(c.CType, c.State, 1, int64(c.EmployeeCnt))
+		cnts = append(cnts, c.EmployeeCnt)
+	}
+	sort.Ints(cnts)
+	for _, p := range StatsPercentiles {
+		s.Employees.Percentiles[PercentileLabel(p)] = Percentile(cnts, p)
+	}
+	return s
+}
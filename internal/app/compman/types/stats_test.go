@@ -0,0 +1,55 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestAggregateCompanies(t *testing.T) {
+	data := []*Company{
+		{Name: "corporation-1", EmployeeCnt: 1000, State: CompanyStateActive, CType: CompanyTypeCorporation},
+		{Name: "corporation-2", EmployeeCnt: 100000, State: CompanyStateActive, CType: CompanyTypeCorporation},
+		{Name: "cooperative-1", EmployeeCnt: 1337, State: CompanyStateSuspended, CType: CompanyTypeCooperative},
+		{Name: "sole-prop-1", EmployeeCnt: 1, CType: CompanyTypeSoleProprietorship},
+		{Name: "sole-prop-2", EmployeeCnt: 3, State: CompanyStateDissolved, CType: CompanyTypeSoleProprietorship},
+	}
+	expected := &CompanyStats{
+		Total: 5,
+		ByType: map[string]int{
+			"corporation":         2,
+			"non-profit":          0,
+			"cooperative":         1,
+			"sole-proprietorship": 2,
+		},
+		ByState: map[string]int{
+			"draft":                1,
+			"pending-registration": 0,
+			"active":               2,
+			"suspended":            1,
+			"dissolved":            1,
+		},
+		Registered:   3,
+		Unregistered: 2,
+		Employees: EmployeeStats{
+			Sum: 102341,
+			Avg: 20468.2,
+			Percentiles: map[string]float64{
+				"p25": 3,
+				"p50": 1000,
+				"p75": 1337,
+				"p90": 60534.8,
+				"p99": 96053.48,
+			},
+		},
+	}
+	got := AggregateCompanies(data)
+	deep.FloatPrecision = 6
+	if diff := deep.Equal(expected, got); diff != nil {
+		t.Errorf("unexpected stats: %v", diff)
+	}
+	empty := AggregateCompanies(nil)
+	if empty.Total != 0 || empty.Employees.Avg != 0 || empty.Employees.Percentiles["p50"] != 0 {
+		t.Errorf("expected zero stats for empty input, got %+v", empty)
+	}
+}
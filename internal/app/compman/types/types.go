@@ -1,6 +1,9 @@
 package types
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	ID       string
@@ -65,10 +68,37 @@ func (c *CompanyType) UnmarshalJSON(data []byte) error {
 }
 
 type Company struct {
-	ID          string      `json:"id"`
-	Name        string      `json:"name"`
-	Desc        *string     `json:"description"`
-	EmployeeCnt int         `json:"employee_count"`
-	Registered  bool        `json:"registered"`
-	CType       CompanyType `json:"type"`
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Desc        *string      `json:"description"`
+	EmployeeCnt int          `json:"employee_count"`
+	State       CompanyState `json:"state"`
+	CType       CompanyType  `json:"type"`
+
+	// legal identifiers, unique per scheme
+	LEI             *string `json:"lei"`
+	VAT             *string `json:"vat"`
+	RegistryCountry *string `json:"registry_country"`
+	RegistryNumber  *string `json:"registry_number"`
+
+	// derived from State, kept for clients predating the lifecycle states
+	Registered bool `json:"registered"`
+
+	// maintained by the store, read-only for clients
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreatedBy string    `json:"created_by"`
+	UpdatedBy string    `json:"updated_by"`
+
+	// set on duplicates merged into another company, they are read-only
+	MergedInto *string `json:"merged_into,omitempty"`
+}
+
+// ClearMetadata resets the fields maintained by the store, so client input can not set them
+func (c *Company) ClearMetadata() {
+	c.CreatedAt = time.Time{}
+	c.UpdatedAt = time.Time{}
+	c.CreatedBy = ""
+	c.UpdatedBy = ""
+	c.MergedInto = nil
 }
@@ -0,0 +1,231 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// limits of the company columns
+const (
+	MaxNameLen = 15
+	MaxDescLen = 3000
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists the invalid fields of a company or patch document
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	l := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		l[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+	return "invalid company, " + strings.Join(l, "; ")
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// result returns e if a field is invalid, fields are sorted so that the
+// errors of map documents are stable
+func (e *ValidationError) result() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	sort.SliceStable(e.Fields, func(i, j int) bool {
+		return e.Fields[i].Field < e.Fields[j].Field
+	})
+	return e
+}
+
+func (e *ValidationError) name(name string) {
+	if len(name) == 0 {
+		e.add("name", "is required")
+	} else if utf8.RuneCountInString(name) > MaxNameLen {
+		e.add("name", "must be at most %d characters", MaxNameLen)
+	}
+}
+
+func (e *ValidationError) description(desc *string) {
+	if desc != nil && utf8.RuneCountInString(*desc) > MaxDescLen {
+		e.add("description", "must be at most %d characters", MaxDescLen)
+	}
+}
+
+func (e *ValidationError) employeeCount(n int) {
+	if n < 0 {
+		e.add("employee_count", "must not be negative")
+	}
+}
+
+func (e *ValidationError) ctype(t CompanyType) {
+	if t < CompanyTypeCorporation || t > CompanyTypeSoleProprietorship {
+		e.add("type", "must be one of corporation, non-profit, cooperative, sole-proprietorship")
+	}
+}
+
+// identifier normalises the identifier s of field, returning nil if it is invalid
+func (e *ValidationError) identifier(field string, s *string, normalize func(string) (string, error)) *string {
+	if s == nil {
+		return nil
+	}
+	v, err := normalize(*s)
+	if err != nil {
+		e.add(field, "%v", err)
+		return nil
+	}
+	return &v
+}
+
+func (e *ValidationError) registry(country, number *string) (*string, *string) {
+	if (country == nil) != (number == nil) {
+		e.add("registry_country", "must be set along with registry_number")
+		return nil, nil
+	}
+	if country == nil {
+		return nil, nil
+	}
+	c, n, err := NormalizeRegistry(*country, *number)
+	if err != nil {
+		e.add("registry_number", "%v", err)
+		return nil, nil
+	}
+	return &c, &n
+}
+
+// Validate checks the company against the limits of the store, replacing
+// its identifiers by their canonical form. The returned error is a
+// *ValidationError.
+func (c *Company) Validate() error {
+	var e ValidationError
+	e.name(c.Name)
+	e.description(c.Desc)
+	e.employeeCount(c.EmployeeCnt)
+	e.ctype(c.CType)
+	if c.State < CompanyStateDraft || c.State > CompanyStateDissolved {
+		e.add("state", "must be one of draft, pending-registration, active, suspended, dissolved")
+	}
+	c.LEI = e.identifier("lei", c.LEI, NormalizeLEI)
+	c.VAT = e.identifier("vat", c.VAT, NormalizeVAT)
+	c.RegistryCountry, c.RegistryNumber = e.registry(c.RegistryCountry, c.RegistryNumber)
+	return e.result()
+}
+
+// patchFields are the fields a patch document may change
+var patchFields = map[string]struct{}{
+	"name": {}, "description": {}, "employee_count": {}, "type": {},
+	"lei": {}, "vat": {}, "registry_country": {}, "registry_number": {},
+}
+
+// ignoredPatchFields are maintained by the service, values sent by clients are dropped
+var ignoredPatchFields = map[string]struct{}{
+	"registered": {}, "created_at": {}, "updated_at": {}, "created_by": {}, "updated_by": {}, "merged_into": {},
+}
+
+// NormalizePatch validates the patch document m of company cur and converts
+// its values to the types of the company fields, so that m only holds the id
+// and patchable fields. The registry country and number are validated
+// together, the one m does not change is taken from cur. The returned error
+// is a *ValidationError.
+func NormalizePatch(cur *Company, m map[string]interface{}) error {
+	var e ValidationError
+	id := cur.ID
+	if v, ok := m["id"]; ok && v != id {
+		e.add("id", "'%v' does not match '%s' of the path", v, id)
+	}
+	m["id"] = id
+	str := func(k string, nullable bool) (*string, bool) {
+		v, ok := m[k]
+		if !ok {
+			return nil, false
+		}
+		if v == nil {
+			if !nullable {
+				e.add(k, "must not be null")
+			}
+			return nil, nullable
+		}
+		s, ok := v.(string)
+		if !ok {
+			e.add(k, "must be a string")
+		}
+		return &s, ok
+	}
+	for k, v := range m {
+		if _, ok := ignoredPatchFields[k]; ok {
+			delete(m, k)
+			continue
+		}
+		if _, ok := patchFields[k]; !ok && k != "id" {
+			if k == "state" {
+				e.add(k, "can only be changed through transitions")
+			} else {
+				e.add(k, "is not a company field")
+			}
+			continue
+		}
+		switch k {
+		case "employee_count":
+			n, ok := v.(float64)
+			if i, isInt := v.(int); isInt {
+				n, ok = float64(i), true
+			}
+			if !ok || n != math.Trunc(n) || n > math.MaxInt32 {
+				e.add(k, "must be an integer")
+				continue
+			}
+			e.employeeCount(int(n))
+			m[k] = int(n)
+		case "type":
+			ctype := CompanyType(-1)
+			switch t := v.(type) {
+			case string:
+				ctype = ParseCompanyType(t)
+			case CompanyType:
+				ctype = t
+			}
+			e.ctype(ctype)
+			m[k] = ctype
+		}
+	}
+	if s, ok := str("name", false); ok {
+		e.name(*s)
+	}
+	if s, ok := str("description", true); ok {
+		e.description(s)
+	}
+	if s, ok := str("lei", true); ok {
+		m["lei"] = e.identifier("lei", s, NormalizeLEI)
+	}
+	if s, ok := str("vat", true); ok {
+		m["vat"] = e.identifier("vat", s, NormalizeVAT)
+	}
+	_, hasCountry := m["registry_country"]
+	_, hasNumber := m["registry_number"]
+	if hasCountry || hasNumber {
+		for k, v := range map[string]*string{"registry_country": cur.RegistryCountry, "registry_number": cur.RegistryNumber} {
+			if _, ok := m[k]; !ok {
+				m[k] = nil
+				if v != nil {
+					m[k] = *v
+				}
+			}
+		}
+	}
+	country, okCountry := str("registry_country", true)
+	number, okNumber := str("registry_number", true)
+	if okCountry && okNumber {
+		m["registry_country"], m["registry_number"] = e.registry(country, number)
+	}
+	return e.result()
+}
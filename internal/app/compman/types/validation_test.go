@@ -0,0 +1,110 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func invalidFields(err error) []string {
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		return nil
+	}
+	l := []string{}
+	for _, f := range ve.Fields {
+		l = append(l, f.Field)
+	}
+	return l
+}
+
+func TestValidateCompany(t *testing.T) {
+	lei, vat, country := "5493001kjtiigc8y1r12", "DE12345678", "GB"
+	long := strings.Repeat("d", MaxDescLen+1)
+	c := Company{Name: "Acme", EmployeeCnt: 1, LEI: &lei}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if *c.LEI != "5493001KJTIIGC8Y1R12" {
+		t.Errorf("LEI not normalized, %s", *c.LEI)
+	}
+	c = Company{Name: "a company name too long", Desc: &long, EmployeeCnt: -1, CType: -1, State: -1,
+		VAT: &vat, RegistryCountry: &country}
+	expected := []string{"description", "employee_count", "name", "registry_country", "state", "type", "vat"}
+	if diff := deep.Equal(invalidFields(c.Validate()), expected); diff != nil {
+		t.Error(diff)
+	}
+	if err := (&Company{}).Validate(); err == nil || !strings.Contains(err.Error(), "name: is required") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNormalizePatch(t *testing.T) {
+	m := map[string]interface{}{"name": "Acme", "employee_count": float64(12), "type": "cooperative",
+		"lei": "5493001kjtiigc8y1r12", "vat": nil, "registry_country": "gb", "registry_number": "0123 4567",
+		"created_at": "2024-01-01T00:00:00Z", "registered": true}
+	if err := NormalizePatch(&Company{ID: "id"}, m); err != nil {
+		t.Fatal(err)
+	}
+	lei, country, number := "5493001KJTIIGC8Y1R12", "GB", "01234567"
+	expected := map[string]interface{}{"id": "id", "name": "Acme", "employee_count": 12, "type": CompanyTypeCooperative,
+		"lei": &lei, "vat": (*string)(nil), "registry_country": &country, "registry_number": &number}
+	if diff := deep.Equal(m, expected); diff != nil {
+		t.Error(diff)
+	}
+	for _, tc := range []struct {
+		m      map[string]interface{}
+		fields []string
+	}{
+		{map[string]interface{}{"id": "other"}, []string{"id"}},
+		{map[string]interface{}{"name; DROP TABLE companies": 1}, []string{"name; DROP TABLE companies"}},
+		{map[string]interface{}{"state": "active"}, []string{"state"}},
+		{map[string]interface{}{"name": nil, "description": 3}, []string{"description", "name"}},
+		{map[string]interface{}{"name": "0123456789abcdef"}, []string{"name"}},
+		{map[string]interface{}{"employee_count": -1.0}, []string{"employee_count"}},
+		{map[string]interface{}{"employee_count": 1.5}, []string{"employee_count"}},
+		{map[string]interface{}{"type": "llc"}, []string{"type"}},
+		{map[string]interface{}{"registry_country": "GB"}, []string{"registry_country"}},
+		{map[string]interface{}{"registry_country": "GB", "registry_number": nil}, []string{"registry_country"}},
+		{map[string]interface{}{"vat": 123}, []string{"vat"}},
+		{map[string]interface{}{"lei": "5493001KJTIIGC8Y1R13"}, []string{"lei"}},
+	} {
+		if diff := deep.Equal(invalidFields(NormalizePatch(&Company{ID: "id"}, tc.m)), tc.fields); diff != nil {
+			t.Errorf("%+v, %v", tc.m, diff)
+		}
+	}
+}
+
+func TestNormalizePatchRegistry(t *testing.T) {
+	gb, number, other := "GB", "01234567", "07654321"
+	cur := &Company{ID: "id", RegistryCountry: &gb, RegistryNumber: &number}
+	tests := []struct {
+		cur      *Company
+		m        map[string]interface{}
+		expected map[string]interface{}
+		fields   []string
+	}{
+		// the unchanged counterpart is taken from the company
+		{cur, map[string]interface{}{"registry_number": "0765 4321"},
+			map[string]interface{}{"id": "id", "registry_country": &gb, "registry_number": &other}, nil},
+		{cur, map[string]interface{}{"registry_country": "gb"},
+			map[string]interface{}{"id": "id", "registry_country": &gb, "registry_number": &number}, nil},
+		{cur, map[string]interface{}{"registry_country": nil, "registry_number": nil},
+			map[string]interface{}{"id": "id", "registry_country": (*string)(nil), "registry_number": (*string)(nil)}, nil},
+		{cur, map[string]interface{}{"name": "Acme"}, map[string]interface{}{"id": "id", "name": "Acme"}, nil},
+		{cur, map[string]interface{}{"registry_number": nil}, nil, []string{"registry_country"}},
+		{&Company{ID: "id"}, map[string]interface{}{"registry_number": "01234567"}, nil, []string{"registry_country"}},
+	}
+	for i, tc := range tests {
+		err := NormalizePatch(tc.cur, tc.m)
+		if diff := deep.Equal(invalidFields(err), tc.fields); diff != nil {
+			t.Errorf("test %d: %v", i, diff)
+			continue
+		}
+		if diff := deep.Equal(tc.m, tc.expected); tc.fields == nil && diff != nil {
+			t.Errorf("test %d: %v", i, diff)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// MediaTypeProblem is the media type of the RFC 7807 error responses
+const MediaTypeProblem = "application/problem+json"
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is a handler error answered with Status, as an RFC 7807 problem.
+// Handlers return it instead of writing the status themselves, other errors
+// are answered with 500.
+type Error struct {
+	Status int
+	// Code identifies the kind of problem for clients, it defaults to the
+	// status text, e.g. not_found
+	Code string
+	// Detail defaults to the message of Err
+	Detail string
+	Fields []FieldError
+	// Ext holds additional members of the problem
+	Ext map[string]interface{}
+	Err error
+}
+
+func NewError(status int, err error) *Error {
+	return &Error{Status: status, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) WithCode(code string) *Error {
+	e.Code = code
+	return e
+}
+
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	e.Fields = append(e.Fields, fields...)
+	return e
+}
+
+// With adds the member key to the problem
+func (e *Error) With(key string, v interface{}) *Error {
+	if e.Ext == nil {
+		e.Ext = map[string]interface{}{}
+	}
+	e.Ext[key] = v
+	return e
+}
+
+// problem returns the members of the problem answering err, the detail of
+// errors other than *Error is not disclosed
+func problem(err error, instance string, correlationID string) (int, map[string]interface{}) {
+	p := map[string]interface{}{}
+	status := http.StatusInternalServerError
+	code := ""
+	var he *Error
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &he) && errors.As(err, &mbe) {
+		// body read through BodyLimit
+		he = NewError(http.StatusRequestEntityTooLarge, err)
+	}
+	if he != nil {
+		for k, v := range he.Ext {
+			p[k] = v
+		}
+		status = he.Status
+		code = he.Code
+		if detail := he.Error(); len(detail) > 0 {
+			p["detail"] = detail
+		}
+		if len(he.Detail) > 0 {
+			p["detail"] = he.Detail
+		}
+		if len(he.Fields) > 0 {
+			p["errors"] = he.Fields
+		}
+	}
+	if len(code) == 0 {
+		code = strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+	p["type"] = "about:blank"
+	p["title"] = http.StatusText(status)
+	p["status"] = status
+	p["code"] = code
+	p["instance"] = instance
+	p["correlation_id"] = correlationID
+	return status, p
+}
+
+// writeProblem answers err as an RFC 7807 problem, the id of the request is
+// its correlation id
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	status, p := problem(err, r.URL.Path, RequestID(r))
+	b, merr := json.Marshal(p)
+	if merr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", MediaTypeProblem)
+	w.WriteHeader(status)
+	w.Write(b)
+}
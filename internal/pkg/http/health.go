@@ -0,0 +1,97 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency of the service is usable, e.g. by
+// pinging a database, it should give up when ctx is done
+type Check func(context.Context) error
+
+// checkTimeout bounds each check of the readiness probe
+const checkTimeout = 2 * time.Second
+
+const (
+	statusOK       = "ok"
+	statusFailing  = "failing"
+	statusDraining = "draining"
+)
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthResp struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, resp healthResp) {
+	status := http.StatusOK
+	if resp.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// healthz is the liveness probe, answering as long as the server handles
+// requests
+func (h *HTTPService) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResp{Status: statusOK})
+}
+
+// readyz is the readiness probe, it runs the checks concurrently and fails if
+// any of them fails or if the service is draining
+func (h *HTTPService) readyz(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeHealth(w, healthResp{Status: statusDraining})
+		return
+	}
+	resp := healthResp{Status: statusOK, Checks: make(map[string]checkResult, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			res := checkResult{Status: statusOK, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Status = statusFailing
+				res.Error = err.Error()
+				resp.Status = statusFailing
+				h.log.Error(fmt.Sprintf("readiness check %s failed, %+v", name, err))
+			}
+			resp.Checks[name] = res
+		}(name, check)
+	}
+	wg.Wait()
+	writeHealth(w, resp)
+}
+
+// Drain fails the readiness probe from now on and waits for the drain delay,
+// so that load balancers stop routing requests before the listener is closed
+func (h *HTTPService) Drain() {
+	if h.draining.Swap(true) {
+		return
+	}
+	if h.drainDelay > 0 {
+		h.log.Info(fmt.Sprintf("draining, readiness fails for %s before stopping", h.drainDelay))
+		time.Sleep(h.drainDelay)
+	}
+}
@@ -2,18 +2,33 @@ package http
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/jmakaron/compman/internal/pkg/requestid"
 	"github.com/jmakaron/compman/pkg/logger"
 )
 
@@ -28,6 +43,9 @@ func (lr *loggedResp) Header() http.Header {
 }
 
 func (lr *loggedResp) Write(b []byte) (int, error) {
+	if lr.status == 0 {
+		lr.status = http.StatusOK
+	}
 	return lr.w.Write(b)
 }
 
@@ -38,12 +56,42 @@ func (lr *loggedResp) WriteHeader(statusCode int) {
 
 type HandlerWithError func(http.ResponseWriter, *http.Request) error
 
+var tracer = otel.Tracer("github.com/jmakaron/compman/internal/pkg/http")
+
+// validRequestID matches the X-Request-ID values accepted from clients, others
+// are replaced by a generated id
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID returns the id of the request, taken from its X-Request-ID header
+// or generated
+func RequestID(r *http.Request) string {
+	return requestid.From(r.Context())
+}
+
+type ctxKey int
+
+const (
+	claimsKey ctxKey = iota
+	runningKey
+)
+
+// Claims returns the jwt claims set by JWTAuth, nil for unauthenticated requests
+func Claims(r *http.Request) jwt.MapClaims {
+	claims, _ := r.Context().Value(claimsKey).(jwt.MapClaims)
+	return claims
+}
+
+// User returns the "user" claim of an authenticated request
+func User(r *http.Request) string {
+	user, _ := Claims(r)["user"].(string)
+	return user
+}
+
 func JWTAuth(handler HandlerWithError) HandlerWithError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		authHeader := r.Header.Get("Authorization")
 		if len(authHeader) == 0 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return nil
+			return NewError(http.StatusUnauthorized, errors.New("missing bearer token"))
 		}
 		tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
 		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
@@ -53,26 +101,163 @@ func JWTAuth(handler HandlerWithError) HandlerWithError {
 			return []byte("MY_SECRET_key"), nil
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return nil
+			return NewError(http.StatusUnauthorized, err)
 		}
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			r = r.WithContext(context.WithValue(r.Context(), "claims", claims))
+			r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
 			return handler(w, r)
 		}
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil
+		return NewError(http.StatusUnauthorized, errors.New("invalid token"))
+	}
+}
+
+// Route is the method and the endpoint suffix regexp of a handler, documented
+// by Doc
+type Route struct {
+	Method string
+	Suffix string
+	Doc    RouteDoc
+}
+
+// first key is endpoint prefix, second key is handler name
+type RouteLayout map[string]map[string]Route
+
+func (rl RouteLayout) prefixes() []string {
+	l := make([]string, 0, len(rl))
+	for prefix := range rl {
+		l = append(l, prefix)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// names returns the handler names of a prefix in registration order, routes
+// with a literal suffix come before variable ones so that e.g. "/stats" is not
+// shadowed by "/{id1}"
+func (rl RouteLayout) names(prefix string) []string {
+	api := rl[prefix]
+	l := make([]string, 0, len(api))
+	for name := range api {
+		l = append(l, name)
 	}
+	sort.Slice(l, func(i, j int) bool {
+		si, sj := api[l[i]].Suffix, api[l[j]].Suffix
+		vi, vj := strings.Contains(si, "{"), strings.Contains(sj, "{")
+		if vi != vj {
+			return !vi
+		}
+		if si != sj {
+			return si < sj
+		}
+		return l[i] < l[j]
+	})
+	return l
 }
 
-// first key is endpoint prefix, second key is handler name, value is [http.Method, <endpoint suffix regexp>]
-type RouteLayout map[string]map[string][]string
+func (rl RouteLayout) has(name string) bool {
+	for _, api := range rl {
+		if _, ok := api[name]; ok {
+			return true
+		}
+	}
+	return false
+}
 
 /* key: handler name
  * value: func(http.ResponseWriter, *http.Request) error
  */
 type RouterSpec map[string]HandlerWithError
 
+// API declares the routes of the service, their handlers and middleware
+type API struct {
+	Layout RouteLayout
+	Spec   RouterSpec
+	// Global middleware wraps every route, the first one outermost
+	Global []Middleware
+	// Middleware of a prefix of Layout or of a handler name, the middleware
+	// of a prefix wraps the middleware of its routes
+	Middleware map[string][]Middleware
+	// Doc documents the service, the OpenAPI document is served if set
+	Doc *APIDoc
+	// Checks of the readiness probe, by dependency name
+	Checks map[string]Check
+}
+
+// validate fails for handler names or prefixes not in the layout, and for
+// routes without handler or doc
+func (api *API) validate(routes map[string]RouteCfg) error {
+	for _, prefix := range api.Layout.prefixes() {
+		for name, route := range api.Layout[prefix] {
+			if api.Spec[name] == nil {
+				return fmt.Errorf("route '%s' has no handler", name)
+			}
+			if len(route.Doc.Summary) == 0 {
+				return fmt.Errorf("route '%s' has no doc", name)
+			}
+		}
+	}
+	for name := range api.Spec {
+		if !api.Layout.has(name) {
+			return fmt.Errorf("handler of unknown route '%s'", name)
+		}
+	}
+	for key := range api.Middleware {
+		if _, ok := api.Layout[key]; !ok && !api.Layout.has(key) {
+			return fmt.Errorf("middleware of unknown prefix or route '%s'", key)
+		}
+	}
+	for key := range routes {
+		if _, ok := api.Layout[key]; !ok && !api.Layout.has(key) {
+			return fmt.Errorf("config of unknown prefix or route '%s'", key)
+		}
+	}
+	return nil
+}
+
+// handler returns the handler of route name of prefix wrapped by its
+// middleware, in the order: body limit, timeout, global, prefix, prefix
+// config, route, route config. The body limit and the timeout are the most
+// specific of the route config, the prefix config and, for the body limit,
+// maxBody. The timeout wraps the route middleware so that e.g. Idempotent
+// only stores or releases its key once the handler returned.
+func (api *API) handler(prefix string, name string, routes map[string]RouteCfg, maxBody int64) HandlerWithError {
+	timeoutMs := 0
+	for _, key := range []string{prefix, name} {
+		if n := routes[key].MaxBodyBytes; n > 0 {
+			maxBody = n
+		}
+		if ms := routes[key].TimeoutMs; ms > 0 {
+			timeoutMs = ms
+		}
+	}
+	mw := []Middleware{BodyLimit(maxBody)}
+	if timeoutMs > 0 {
+		mw = append(mw, Timeout(time.Duration(timeoutMs)*time.Millisecond))
+	}
+	mw = append(mw, api.Global...)
+	mw = append(mw, api.Middleware[prefix]...)
+	mw = append(mw, routes[prefix].middleware()...)
+	mw = append(mw, api.Middleware[name]...)
+	mw = append(mw, routes[name].middleware()...)
+	return chain(api.Spec[name], mw...)
+}
+
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxBodyBytes      = 4 << 20
+)
+
+// msOr returns ms milliseconds, def if ms is not positive
+func msOr(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type HTTPServiceCfg struct {
 	Secure    bool   `json:"secure"`
 	Addr      string `json:"addr"`
@@ -80,7 +265,28 @@ type HTTPServiceCfg struct {
 	CertFile  string `json:"cert_file,omitempty"`
 	KeyFile   string `json:"key_file,omitempty"`
 	SrvPrefix string `json:"service_prefix"`
-	Debug     bool   `json:"-"`
+	// Routes configures the middleware of prefixes and routes, key is a
+	// prefix of the layout or a handler name
+	Routes map[string]RouteCfg `json:"routes,omitempty"`
+	// timeouts of the server, see http.Server, the defaults apply if 0
+	ReadHeaderTimeoutMs int `json:"read_header_timeout_ms,omitempty"`
+	ReadTimeoutMs       int `json:"read_timeout_ms,omitempty"`
+	WriteTimeoutMs      int `json:"write_timeout_ms,omitempty"`
+	IdleTimeoutMs       int `json:"idle_timeout_ms,omitempty"`
+	// MaxHeaderBytes limits the size of the request headers, 1MB if 0
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+	// MaxBodyBytes limits the size of the request bodies of the routes
+	// without max_body_bytes in Routes, 4MB if 0
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// Docs serves a docs page of the OpenAPI document at /docs
+	Docs  bool `json:"docs"`
+	Debug bool `json:"-"`
+	// MetricsAddr is the address of a separate listener serving /metrics,
+	// the metrics are served by the main listener if empty
+	MetricsAddr string `json:"metrics_addr,omitempty"`
+	// DrainDelayMs is how long the readiness probe fails before the listener
+	// is closed on Drain
+	DrainDelayMs int `json:"drain_delay_ms,omitempty"`
 }
 
 type HTTPService struct {
@@ -94,42 +300,140 @@ type HTTPService struct {
 	Scheme   string
 	ep       string
 	prefix   string
+	// admin serves the metrics, if on a separate listener
+	admin *http.Server
+	// checks of the readiness probe, failing once draining is set
+	checks     map[string]Check
+	draining   atomic.Bool
+	drainDelay time.Duration
+	// running counts the handlers still running, awaited by Stop
+	running atomic.Int64
+}
+
+// hold counts a handler running apart from its request until release is
+// called, e.g. one abandoned by Timeout, so that Stop awaits it
+func hold(r *http.Request) (release func()) {
+	n, ok := r.Context().Value(runningKey).(*atomic.Int64)
+	if !ok {
+		return func() {}
+	}
+	n.Add(1)
+	return func() { n.Add(-1) }
 }
 
-func (h *HTTPService) wrapHandler(handler HandlerWithError) http.HandlerFunc {
+// wrapHandler recovers the panics of the handler of route name, answers its
+// errors as problems and records the metrics of the requests
+func (h *HTTPService) wrapHandler(name string, handler HandlerWithError) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		httpInFlight.Inc()
 		srcIP, _, _ := net.SplitHostPort(r.RemoteAddr)
 		reqURL := r.URL.String()
 		start := time.Now()
 		var handlerErr error
 		lr := &loggedResp{w: w}
+		requestID := r.Header.Get(requestid.Header)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestid.Header, requestID)
+		// the span of the request continues the trace of its traceparent header
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path),
+				attribute.String("request_id", requestID)))
+		r = r.WithContext(context.WithValue(requestid.With(ctx, requestID), runningKey, &h.running))
+		release := hold(r)
+		defer release()
 		defer func() {
 			var logErr error
 			var logMsg string
-			if r := recover(); r != nil {
-				buf := make([]byte, 1<<16)
-				runtime.Stack(buf, false)
-				h.log.Error(string(buf))
-				logErr = fmt.Errorf("%v", r)
-			} else {
-				logErr = handlerErr
+			var aborted bool
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					// the abort goes on to the server once the request is recorded
+					aborted = true
+					handlerErr = http.ErrAbortHandler
+				} else {
+					handlerErr = h.recovered(name, p, lr, r)
+				}
 			}
-			logMsg = fmt.Sprintf("[%s %s] %v %v %v [%v] (%v) <%#v>",
+			logErr = handlerErr
+			logMsg = fmt.Sprintf("[%s %s] %v %v %v [%v] (%v) <%#v> request_id=%s",
 				h.Scheme, h.srv.Addr, srcIP, r.Method, reqURL,
 				lr.status, time.Since(start),
-				logErr)
+				logErr, requestID)
 			if handlerErr != nil {
 				h.log.Error(logMsg)
 			} else {
 				h.log.Info(logMsg)
 			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(lr.status))
+			if handlerErr != nil {
+				span.RecordError(handlerErr)
+				if lr.status >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, handlerErr.Error())
+				}
+			}
+			span.End()
+			httpInFlight.Dec()
+			httpRequests.WithLabelValues(name, r.Method, statusClass(lr.status)).Inc()
+			httpDuration.WithLabelValues(name, r.Method).Observe(time.Since(start).Seconds())
+			if aborted {
+				panic(http.ErrAbortHandler)
+			}
 		}()
 		handlerErr = handler(lr, r)
+		// errors of handlers that did not answer are answered as problems
+		if handlerErr != nil && lr.status == 0 {
+			writeProblem(lr, r, handlerErr)
+		}
+	}
+}
+
+// recovered handles the panic p of the handler of route name, answering it
+// if nothing was sent yet, and returns the error of the request
+func (h *HTTPService) recovered(name string, p interface{}, lr *loggedResp, r *http.Request) error {
+	httpPanics.WithLabelValues(name).Inc()
+	buf := make([]byte, 1<<16)
+	buf = buf[:runtime.Stack(buf, false)]
+	err := fmt.Errorf("panic: %v", p)
+	if lr.status == 0 {
+		writeProblem(lr, r, err)
 	}
+	h.log.Error(fmt.Sprintf("%s request_id=%s", buf, RequestID(r)))
+	return err
 }
 
-func (h *HTTPService) Init(cfg HTTPServiceCfg, layout RouteLayout, rspec *RouterSpec, log *logger.Logger) error {
+// serveAPIDoc serves the OpenAPI document of api at /openapi.json of r, and
+// the docs page at /docs if enabled
+func (h *HTTPService) serveAPIDoc(r *mux.Router, cfg HTTPServiceCfg, api *API) error {
+	b, err := json.Marshal(api.OpenAPI(cfg.SrvPrefix, cfg.Routes))
+	if err != nil {
+		return err
+	}
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods(http.MethodGet)
+	if cfg.Docs {
+		page := []byte(fmt.Sprintf(docsPage, html.EscapeString(api.Doc.Title)))
+		r.HandleFunc("/docs", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write(page)
+		}).Methods(http.MethodGet)
+	}
+	return nil
+}
+
+// Init registers the routes of api, it fails if the names of api or of the
+// route config are inconsistent with the layout
+func (h *HTTPService) Init(cfg HTTPServiceCfg, api *API, log *logger.Logger) error {
 	h.log = log
+	if err := api.validate(cfg.Routes); err != nil {
+		return err
+	}
 	h.certFile = cfg.CertFile
 	h.keyFile = cfg.KeyFile
 	if cfg.Port == 0 {
@@ -142,8 +446,30 @@ func (h *HTTPService) Init(cfg HTTPServiceCfg, layout RouteLayout, rspec *Router
 	} else {
 		h.Scheme = "http"
 	}
-	h.srv = &http.Server{Addr: h.ep}
+	h.srv = &http.Server{
+		Addr:              h.ep,
+		ReadHeaderTimeout: msOr(cfg.ReadHeaderTimeoutMs, defaultReadHeaderTimeout),
+		ReadTimeout:       msOr(cfg.ReadTimeoutMs, defaultReadTimeout),
+		WriteTimeout:      msOr(cfg.WriteTimeoutMs, defaultWriteTimeout),
+		IdleTimeout:       msOr(cfg.IdleTimeoutMs, defaultIdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
+	}
 	router := mux.NewRouter()
+	if len(cfg.MetricsAddr) > 0 {
+		admin := mux.NewRouter()
+		admin.Handle("/metrics", promhttp.Handler())
+		h.admin = &http.Server{Addr: cfg.MetricsAddr, Handler: admin, ReadHeaderTimeout: h.srv.ReadHeaderTimeout}
+	} else {
+		router.Handle("/metrics", promhttp.Handler())
+	}
+	h.checks = api.Checks
+	h.drainDelay = time.Duration(cfg.DrainDelayMs) * time.Millisecond
+	router.HandleFunc("/healthz", h.healthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", h.readyz).Methods(http.MethodGet)
 	if cfg.Debug {
 		router.PathPrefix("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
 		router.PathPrefix("/debug/pprof/profile").HandlerFunc(pprof.Profile)
@@ -152,13 +478,19 @@ func (h *HTTPService) Init(cfg HTTPServiceCfg, layout RouteLayout, rspec *Router
 		router.PathPrefix("/debug/pprof").HandlerFunc(pprof.Index)
 	}
 	r := router.PathPrefix(fmt.Sprintf("/%s", cfg.SrvPrefix)).Subrouter()
-	for prefix, api := range layout {
+	if api.Doc != nil {
+		if err := h.serveAPIDoc(r, cfg, api); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range api.Layout.prefixes() {
+		routes := api.Layout[prefix]
 		entry := r.PathPrefix(prefix).Subrouter()
-		for name, apiData := range api {
-			if handler := (*rspec)[name]; handler != nil {
-				entry.HandleFunc(apiData[1], h.wrapHandler(handler)).Methods(apiData[0]).Name(name)
-				h.log.Debug(fmt.Sprintf("registered %s: %s %s%s", name, apiData[0], prefix, apiData[1]))
-			}
+		for _, name := range api.Layout.names(prefix) {
+			route := routes[name]
+			entry.HandleFunc(route.Suffix, h.wrapHandler(name, api.handler(prefix, name, cfg.Routes, maxBody))).
+				Methods(route.Method).Name(name)
+			h.log.Debug(fmt.Sprintf("registered %s: %s %s%s", name, route.Method, prefix, route.Suffix))
 		}
 	}
 	h.srv.Handler = router
@@ -193,14 +525,50 @@ func (h *HTTPService) Start() error {
 		h.log.Info(fmt.Sprintf("started http service endpoint ( %s://%s/%s )", h.Scheme, h.ep, h.prefix))
 	case err = <-errCh:
 	}
+	if err == nil && h.admin != nil {
+		go func() {
+			if err := h.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				h.log.Error(fmt.Sprintf("failed to start metrics listener: %+v", err))
+			}
+		}()
+		h.log.Info(fmt.Sprintf("serving metrics at http://%s/metrics", h.admin.Addr))
+	}
 	return err
 }
 
-func (h *HTTPService) Stop() error {
-	var err error
-	if h.cancel != nil {
-		h.cancel()
-		err = h.srv.Shutdown(context.Background())
+// runningPoll is how often Stop checks whether the handlers returned
+const runningPoll = 10 * time.Millisecond
+
+// Stop closes the listeners and waits for the running handlers until ctx is
+// done, the connections of the requests still running are then closed and
+// the requests reported as cut off
+func (h *HTTPService) Stop(ctx context.Context) error {
+	if h.cancel == nil {
+		return nil
+	}
+	h.cancel()
+	err := h.srv.Shutdown(ctx)
+	if err == nil || errors.Is(err, ctx.Err()) {
+		// handlers abandoned by Timeout outlive their connection
+		err = nil
+		t := time.NewTicker(runningPoll)
+		defer t.Stop()
+		for h.running.Load() > 0 && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+		}
+		if n := h.running.Load(); n > 0 {
+			err = fmt.Errorf("%d requests cut off, %w", n, ctx.Err())
+			h.srv.Close()
+		}
+	}
+	if h.admin != nil {
+		if aerr := h.admin.Shutdown(ctx); aerr != nil {
+			h.admin.Close()
+			err = errors.Join(err, aerr)
+		}
 	}
 	return err
 }
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/jmakaron/compman/pkg/logger"
+)
+
+func TestWrapHandlerPanics(t *testing.T) {
+	tests := []struct {
+		handler HandlerWithError
+		// aborts are passed on to the server
+		aborted  bool
+		expected int
+	}{
+		{ok, false, http.StatusOK},
+		{func(w http.ResponseWriter, r *http.Request) error { panic("boom") }, false, http.StatusInternalServerError},
+		{func(w http.ResponseWriter, r *http.Request) error { panic(http.ErrAbortHandler) }, true, 0},
+	}
+	log, err := logger.New(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HTTPService{log: log, srv: &http.Server{}}
+	for i, tc := range tests {
+		inFlight := testutil.ToFloat64(httpInFlight)
+		w := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if p := recover(); (p == http.ErrAbortHandler) != tc.aborted {
+					t.Errorf("test %d: unexpected panic %v", i, p)
+				}
+			}()
+			h.wrapHandler("test", tc.handler)(w, httptest.NewRequest(http.MethodGet, "/company", nil))
+		}()
+		if !tc.aborted && w.Code != tc.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tc.expected, w.Code)
+		}
+		if n := testutil.ToFloat64(httpInFlight); n != inFlight {
+			t.Errorf("test %d: %v requests in flight, expected %v", i, n, inFlight)
+		}
+		if n := h.running.Load(); n != 0 {
+			t.Errorf("test %d: %d handlers running", i, n)
+		}
+	}
+}
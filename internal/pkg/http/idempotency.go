@@ -0,0 +1,143 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a reused key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 255
+)
+
+// ErrKeyInUse is returned by IdempotencyStore.Reserve for keys already reserved
+var ErrKeyInUse = errors.New("idempotency key in use")
+
+// StoredResponse is the response kept for an idempotency key, Status is 0
+// while the first request with the key is being handled
+type StoredResponse struct {
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore keeps the responses of requests sent with an
+// Idempotency-Key until the keys expire
+type IdempotencyStore interface {
+	// Reserve claims the key for the request fingerprint, failing with
+	// ErrKeyInUse along with the stored response if it is not expired
+	Reserve(ctx context.Context, key string, fingerprint string) (*StoredResponse, error)
+	// Save stores the response of the request holding the key
+	Save(ctx context.Context, key string, resp *StoredResponse) error
+	// Release drops the key, so that the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+type recordedResp struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *recordedResp) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *recordedResp) WriteHeader(statusCode int) {
+	rr.status = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// fingerprint identifies the request by its user, method, path and body
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", User(r), r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Idempotent replays the stored response of requests repeating the
+// Idempotency-Key of an earlier request, keys are scoped to the jwt user so
+// it goes after JWTAuth. A key reused with a different request gets 422, and
+// 409 while the first request is being handled. Responses with a server error
+// are not stored, the request can be retried with the same key.
+func Idempotent(st IdempotencyStore, handler HandlerWithError) HandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if len(key) == 0 {
+			return handler(w, r)
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return NewError(http.StatusBadRequest,
+				fmt.Errorf("%s longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLen))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		key = User(r) + ":" + key
+		fp := fingerprint(r, body)
+		ctx := context.Background()
+		stored, err := st.Reserve(ctx, key, fp)
+		if errors.Is(err, ErrKeyInUse) {
+			switch {
+			case stored.Fingerprint != fp:
+				return NewError(http.StatusUnprocessableEntity,
+					fmt.Errorf("%s reused with a different request", IdempotencyKeyHeader))
+			case stored.Status == 0:
+				return NewError(http.StatusConflict,
+					fmt.Errorf("request with the same %s in progress", IdempotencyKeyHeader))
+			}
+			if len(stored.ContentType) > 0 {
+				w.Header().Set("content-type", stored.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// a panicking handler must not keep the key reserved
+			if p := recover(); p != nil {
+				st.Release(ctx, key)
+				panic(p)
+			}
+		}()
+		rr := &recordedResp{ResponseWriter: w}
+		handlerErr := handler(rr, r)
+		// client errors are answered here, so that their problem is stored
+		var he *Error
+		if rr.status == 0 && errors.As(handlerErr, &he) && he.Status < http.StatusInternalServerError {
+			writeProblem(rr, r, handlerErr)
+		}
+		if rr.status == 0 || rr.status >= http.StatusInternalServerError {
+			err = st.Release(ctx, key)
+		} else {
+			err = st.Save(ctx, key, &StoredResponse{Fingerprint: fp, Status: rr.status,
+				ContentType: rr.Header().Get("content-type"), Body: rr.body.Bytes()})
+		}
+		if handlerErr == nil && err != nil {
+			handlerErr = fmt.Errorf("failed to store the response of the %s, %w", IdempotencyKeyHeader, err)
+		}
+		return handlerErr
+	}
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// memStore is an IdempotencyStore in memory, without expiry
+type memStore struct {
+	mu   sync.Mutex
+	keys map[string]*StoredResponse
+}
+
+func (s *memStore) Reserve(ctx context.Context, key string, fingerprint string) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.keys[key]; ok {
+		return stored, ErrKeyInUse
+	}
+	s.keys[key] = &StoredResponse{Fingerprint: fingerprint}
+	return nil, nil
+}
+
+func (s *memStore) Save(ctx context.Context, key string, resp *StoredResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = resp
+	return nil
+}
+
+func (s *memStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+	return nil
+}
+
+func idempotentReq(key string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/company", strings.NewReader(body))
+	if len(key) > 0 {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	return withClaims(r, jwt.MapClaims{"user": "u"})
+}
+
+func TestIdempotent(t *testing.T) {
+	created := func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"1"}`))
+		return nil
+	}
+	failing := func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("store down")
+	}
+	tests := []struct {
+		handler HandlerWithError
+		// requests sent in order, with their key and body
+		requests [][2]string
+		expected []int
+		// calls of the handler
+		calls    int
+		replayed bool
+	}{
+		// a replay answers the stored response without calling the handler
+		{created, [][2]string{{"k", `{"name":"acme"}`}, {"k", `{"name":"acme"}`}},
+			[]int{http.StatusCreated, http.StatusCreated}, 1, true},
+		{created, [][2]string{{"k", `{"name":"acme"}`}, {"k", `{"name":"other"}`}},
+			[]int{http.StatusCreated, http.StatusUnprocessableEntity}, 1, false},
+		{created, [][2]string{{"k1", `{"name":"acme"}`}, {"k2", `{"name":"acme"}`}},
+			[]int{http.StatusCreated, http.StatusCreated}, 2, false},
+		{created, [][2]string{{"", `{"name":"acme"}`}, {"", `{"name":"acme"}`}},
+			[]int{http.StatusCreated, http.StatusCreated}, 2, false},
+		// server errors release the key, the request can be retried
+		{failing, [][2]string{{"k", `{"name":"acme"}`}, {"k", `{"name":"acme"}`}},
+			[]int{http.StatusInternalServerError, http.StatusInternalServerError}, 2, false},
+		{created, [][2]string{{strings.Repeat("k", maxIdempotencyKeyLen+1), `{}`}},
+			[]int{http.StatusBadRequest}, 0, false},
+	}
+	for i, tc := range tests {
+		st := &memStore{keys: map[string]*StoredResponse{}}
+		calls := 0
+		h := Idempotent(st, func(w http.ResponseWriter, r *http.Request) error {
+			calls++
+			return tc.handler(w, r)
+		})
+		var w *httptest.ResponseRecorder
+		for j, req := range tc.requests {
+			w = serve(h, idempotentReq(req[0], req[1]))
+			if w.Code != tc.expected[j] {
+				t.Errorf("test %d, request %d: expected %d, got %d", i, j, tc.expected[j], w.Code)
+			}
+		}
+		if calls != tc.calls {
+			t.Errorf("test %d: expected %d calls, got %d", i, tc.calls, calls)
+		}
+		if replayed := w.Header().Get(IdempotentReplayedHeader) == "true"; replayed != tc.replayed {
+			t.Errorf("test %d: expected replayed %v, got %v", i, tc.replayed, replayed)
+		}
+		if tc.replayed && w.Body.String() != `{"id":"1"}` {
+			t.Errorf("test %d: unexpected replayed body %s", i, w.Body.String())
+		}
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	st := &memStore{keys: map[string]*StoredResponse{}}
+	started, done := make(chan struct{}), make(chan struct{})
+	h := Idempotent(st, func(w http.ResponseWriter, r *http.Request) error {
+		close(started)
+		<-done
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+	first := make(chan int)
+	go func() {
+		first <- serve(h, idempotentReq("k", `{}`)).Code
+	}()
+	<-started
+	if w := serve(h, idempotentReq("k", `{}`)); w.Code != http.StatusConflict {
+		t.Errorf("expected %d while in flight, got %d", http.StatusConflict, w.Code)
+	}
+	close(done)
+	if code := <-first; code != http.StatusCreated {
+		t.Errorf("expected %d, got %d", http.StatusCreated, code)
+	}
+	if w := serve(h, idempotentReq("k", `{}`)); w.Code != http.StatusCreated ||
+		w.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("expected a replayed %d, got %d", http.StatusCreated, w.Code)
+	}
+}
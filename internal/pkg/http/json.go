@@ -0,0 +1,39 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+var ErrTrailingData = errors.New("unexpected data after the JSON value")
+
+// UnmarshalJSON decodes b into v like json.Unmarshal, but fails on fields
+// unknown to v and on data after the JSON value
+func UnmarshalJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// DecodeJSON reads the body of r and decodes it into v with UnmarshalJSON,
+// invalid bodies are answered with 400 and bodies over the limit with 413
+func DecodeJSON(r *http.Request, v interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err = UnmarshalJSON(b, v); err != nil {
+		return NewError(http.StatusBadRequest, err)
+	}
+	return nil
+}
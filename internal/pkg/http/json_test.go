@@ -0,0 +1,133 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+type testBody struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected testBody
+		err      error
+		ok       bool
+	}{
+		{`{"name":"acme","count":2}`, testBody{Name: "acme", Count: 2}, nil, true},
+		{` {"name":"acme"} ` + "\n", testBody{Name: "acme"}, nil, true},
+		{`{"name":"acme","unknown":1}`, testBody{}, nil, false},
+		{`{"name":"acme"}{"name":"other"}`, testBody{}, ErrTrailingData, false},
+		{`{"name":"acme"} x`, testBody{}, ErrTrailingData, false},
+		{`{"name":"acme"`, testBody{}, nil, false},
+	}
+	for i, tc := range tests {
+		var v testBody
+		err := UnmarshalJSON([]byte(tc.in), &v)
+		if (err == nil) != tc.ok {
+			t.Errorf("test %d: expected ok %v, got %v", i, tc.ok, err)
+			continue
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("test %d: expected %v, got %v", i, tc.err, err)
+		}
+		if diff := deep.Equal(v, tc.expected); tc.ok && diff != nil {
+			t.Errorf("test %d: %v", i, diff)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	decode := func(w http.ResponseWriter, r *http.Request) error {
+		var v testBody
+		if err := DecodeJSON(r, &v); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	big := `{"name":"` + strings.Repeat("a", 64) + `"}`
+	tests := []struct {
+		body string
+		// chunked bodies have no content length, they fail while read
+		chunked  bool
+		expected int
+	}{
+		{`{"name":"acme"}`, false, http.StatusOK},
+		{`{"name":"acme","unknown":1}`, false, http.StatusBadRequest},
+		{`{"name":"acme"} {}`, false, http.StatusBadRequest},
+		{`not json`, false, http.StatusBadRequest},
+		{big, false, http.StatusRequestEntityTooLarge},
+		{big, true, http.StatusRequestEntityTooLarge},
+	}
+	for i, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/company", strings.NewReader(tc.body))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		w := serve(BodyLimit(32)(decode), r)
+		if w.Code != tc.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tc.expected, w.Code)
+		}
+		if w.Code != http.StatusOK && w.Header().Get("content-type") != MediaTypeProblem {
+			t.Errorf("test %d: expected a problem, got %s", i, w.Header().Get("content-type"))
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected map[string]interface{}
+	}{
+		{NewError(http.StatusNotFound, errors.New("company not found")), map[string]interface{}{
+			"status": 404.0, "title": "Not Found", "code": "not_found", "detail": "company not found"}},
+		{NewError(http.StatusConflict, errors.New("duplicate")).WithCode("likely_duplicate").With("threshold", 0.8),
+			map[string]interface{}{"status": 409.0, "title": "Conflict", "code": "likely_duplicate",
+				"detail": "duplicate", "threshold": 0.8}},
+		{NewError(http.StatusBadRequest, errors.New("invalid company")).
+			WithFields(FieldError{Field: "name", Message: "required"}),
+			map[string]interface{}{"status": 400.0, "title": "Bad Request", "code": "bad_request",
+				"detail": "invalid company",
+				"errors": []interface{}{map[string]interface{}{"field": "name", "message": "required"}}}},
+		{&Error{Status: http.StatusForbidden, Detail: "not allowed", Err: errors.New("user u lacks a role")},
+			map[string]interface{}{"status": 403.0, "title": "Forbidden", "code": "forbidden", "detail": "not allowed"}},
+		// the detail of other errors is not disclosed
+		{errors.New("connection refused"), map[string]interface{}{
+			"status": 500.0, "title": "Internal Server Error", "code": "internal_server_error"}},
+		{&http.MaxBytesError{Limit: 32}, map[string]interface{}{
+			"status": 413.0, "title": "Request Entity Too Large", "code": "request_entity_too_large",
+			"detail": "http: request body too large"}},
+	}
+	for i, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/company/1", nil)
+		w := httptest.NewRecorder()
+		writeProblem(w, r, tc.err)
+		if ct := w.Header().Get("content-type"); ct != MediaTypeProblem {
+			t.Errorf("test %d: expected %s, got %s", i, MediaTypeProblem, ct)
+		}
+		var p map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if int(p["status"].(float64)) != w.Code {
+			t.Errorf("test %d: status %v answered with %d", i, p["status"], w.Code)
+		}
+		tc.expected["type"] = "about:blank"
+		tc.expected["instance"] = "/company/1"
+		tc.expected["correlation_id"] = ""
+		if diff := deep.Equal(p, tc.expected); diff != nil {
+			t.Errorf("test %d: %v", i, diff)
+		}
+	}
+}
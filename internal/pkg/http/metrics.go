@@ -0,0 +1,36 @@
+package http
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Handled requests, by route name, method and status class (2xx, 4xx, ...).",
+	}, []string{"route", "method", "status_class"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of the handled requests, by route name and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests being handled.",
+	})
+	httpPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_handler_panics_total",
+		Help: "Panics recovered from the handlers, by route name.",
+	}, []string{"route"})
+)
+
+func statusClass(status int) string {
+	if status == 0 {
+		// nothing written, net/http answers 200
+		status = 200
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
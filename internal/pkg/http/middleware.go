@@ -0,0 +1,239 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler, e.g. JWTAuth
+type Middleware func(HandlerWithError) HandlerWithError
+
+// chain wraps handler with mw, the first middleware outermost
+func chain(handler HandlerWithError, mw ...Middleware) HandlerWithError {
+	for i := len(mw) - 1; i >= 0; i-- {
+		handler = mw[i](handler)
+	}
+	return handler
+}
+
+// RouteCfg configures the middleware of a prefix or of a route
+type RouteCfg struct {
+	// Roles of which the jwt user must have one
+	Roles []string `json:"roles,omitempty"`
+	// RateLimit is the number of requests per second allowed to each client,
+	// with bursts of up to Burst requests
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+	// MaxBodyBytes limits the size of the request body, the limit of a route
+	// overrides the one of its prefix and the default of the service
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// TimeoutMs bounds the handling of a request, the timeout of a route
+	// overrides the one of its prefix
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+}
+
+// middleware returns the middleware configured by rc, in the order rate limit
+// and roles. The body limit and the timeout are applied once by API.handler.
+func (rc RouteCfg) middleware() []Middleware {
+	l := []Middleware{}
+	if rc.RateLimit > 0 {
+		l = append(l, RateLimit(rc.RateLimit, rc.Burst))
+	}
+	if len(rc.Roles) > 0 {
+		l = append(l, RequireRoles(rc.Roles...))
+	}
+	return l
+}
+
+// Roles returns the "roles" claim of an authenticated request
+func Roles(r *http.Request) []string {
+	l, _ := Claims(r)["roles"].([]interface{})
+	roles := make([]string, 0, len(l))
+	for _, v := range l {
+		if role, ok := v.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// RequireRoles answers 403 to users without any of roles, requests not
+// authenticated yet are authenticated with JWTAuth
+func RequireRoles(roles ...string) Middleware {
+	return func(handler HandlerWithError) HandlerWithError {
+		check := func(w http.ResponseWriter, r *http.Request) error {
+			for _, have := range Roles(r) {
+				for _, role := range roles {
+					if have == role {
+						return handler(w, r)
+					}
+				}
+			}
+			return NewError(http.StatusForbidden, fmt.Errorf("user '%s' requires one of the roles %v", User(r), roles)).
+				WithCode("missing_role")
+		}
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if Claims(r) == nil {
+				return JWTAuth(check)(w, r)
+			}
+			return check(w, r)
+		}
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit answers 429 to the clients sending more than rps requests per
+// second, after a burst of up to burst requests. Clients are told apart by
+// their jwt user, or their address if not authenticated.
+func RateLimit(rps float64, burst int) Middleware {
+	if burst < 1 {
+		burst = 1
+	}
+	var mu sync.Mutex
+	buckets := map[string]*bucket{}
+	allow := func(client string) (bool, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if len(buckets) > 10000 {
+			// drop the buckets refilled since
+			for k, b := range buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*rps >= float64(burst) {
+					delete(buckets, k)
+				}
+			}
+		}
+		b, ok := buckets[client]
+		if !ok {
+			b = &bucket{tokens: float64(burst), last: now}
+			buckets[client] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * rps
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+		}
+		b.tokens--
+		return true, 0
+	}
+	return func(handler HandlerWithError) HandlerWithError {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			client := User(r)
+			if len(client) == 0 {
+				client, _, _ = net.SplitHostPort(r.RemoteAddr)
+			}
+			if ok, wait := allow(client); !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+				return NewError(http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+			}
+			return handler(w, r)
+		}
+	}
+}
+
+// BodyLimit fails reading request bodies larger than n bytes, the error is
+// answered with 413
+func BodyLimit(n int64) Middleware {
+	return func(handler HandlerWithError) HandlerWithError {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if r.ContentLength > n {
+				return NewError(http.StatusRequestEntityTooLarge,
+					fmt.Errorf("request body of %d bytes, at most %d are allowed", r.ContentLength, n))
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			return handler(w, r)
+		}
+	}
+}
+
+// timeoutResp buffers the response of a handler, which is dropped if the
+// handler times out
+type timeoutResp struct {
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (tr *timeoutResp) Header() http.Header {
+	return tr.header
+}
+
+func (tr *timeoutResp) Write(b []byte) (int, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tr.status == 0 {
+		tr.status = http.StatusOK
+	}
+	return tr.body.Write(b)
+}
+
+func (tr *timeoutResp) WriteHeader(statusCode int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.timedOut && tr.status == 0 {
+		tr.status = statusCode
+	}
+}
+
+// Timeout answers 503 to requests not handled within d. The context of the
+// request is cancelled, the response of the handler is dropped.
+func Timeout(d time.Duration) Middleware {
+	return func(handler HandlerWithError) HandlerWithError {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			tr := &timeoutResp{header: http.Header{}}
+			done := make(chan error, 1)
+			panicked := make(chan interface{}, 1)
+			release := hold(r)
+			go func() {
+				defer release()
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				done <- handler(tr, r.WithContext(ctx))
+			}()
+			select {
+			case p := <-panicked:
+				panic(p)
+			case err := <-done:
+				tr.mu.Lock()
+				defer tr.mu.Unlock()
+				for k, v := range tr.header {
+					w.Header()[k] = v
+				}
+				if tr.status != 0 {
+					w.WriteHeader(tr.status)
+					w.Write(tr.body.Bytes())
+				}
+				return err
+			case <-ctx.Done():
+				tr.mu.Lock()
+				defer tr.mu.Unlock()
+				tr.timedOut = true
+				return NewError(http.StatusServiceUnavailable, fmt.Errorf("request not handled within %s", d)).
+					WithCode("timeout")
+			}
+		}
+	}
+}
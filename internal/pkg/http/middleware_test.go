@@ -0,0 +1,143 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// serve answers r with handler, errors are answered as problems like the
+// handlers of HTTPService
+func serve(handler HandlerWithError, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	if err := handler(w, r); err != nil {
+		writeProblem(w, r, err)
+	}
+	return w
+}
+
+func ok(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// withClaims returns r as authenticated by JWTAuth with claims
+func withClaims(r *http.Request, claims jwt.MapClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		burst    int
+		requests int
+		expected []int
+	}{
+		{0, 2, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{1, 2, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{3, 4, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}},
+	}
+	for i, tc := range tests {
+		// a single token every 100s, none is refilled during the test
+		h := RateLimit(0.01, tc.burst)(ok)
+		for j := 0; j < tc.requests; j++ {
+			r := httptest.NewRequest(http.MethodGet, "/company", nil)
+			w := serve(h, r)
+			if w.Code != tc.expected[j] {
+				t.Errorf("test %d, request %d: expected %d, got %d", i, j, tc.expected[j], w.Code)
+			}
+			if w.Code == http.StatusTooManyRequests && len(w.Header().Get("Retry-After")) == 0 {
+				t.Errorf("test %d, request %d: missing Retry-After", i, j)
+			}
+		}
+		// other clients have their own limit
+		r := withClaims(httptest.NewRequest(http.MethodGet, "/company", nil), jwt.MapClaims{"user": "other"})
+		if w := serve(h, r); w.Code != http.StatusOK {
+			t.Errorf("test %d, other client: expected %d, got %d", i, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		handler  HandlerWithError
+		expected int
+	}{
+		{time.Second, ok, http.StatusOK},
+		{10 * time.Millisecond, func(w http.ResponseWriter, r *http.Request) error {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		}, http.StatusServiceUnavailable},
+		{time.Second, func(w http.ResponseWriter, r *http.Request) error {
+			return NewError(http.StatusNotFound, context.Canceled)
+		}, http.StatusNotFound},
+	}
+	for i, tc := range tests {
+		w := serve(Timeout(tc.d)(tc.handler), httptest.NewRequest(http.MethodGet, "/company", nil))
+		if w.Code != tc.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestRequireRoles(t *testing.T) {
+	tests := []struct {
+		roles    []string
+		claims   jwt.MapClaims
+		expected int
+	}{
+		{[]string{"admin"}, jwt.MapClaims{"user": "u", "roles": []interface{}{"admin"}}, http.StatusOK},
+		{[]string{"admin", "reviewer"}, jwt.MapClaims{"user": "u", "roles": []interface{}{"viewer", "reviewer"}}, http.StatusOK},
+		{[]string{"admin"}, jwt.MapClaims{"user": "u", "roles": []interface{}{"viewer"}}, http.StatusForbidden},
+		{[]string{"admin"}, jwt.MapClaims{"user": "u"}, http.StatusForbidden},
+		// not authenticated, JWTAuth answers
+		{[]string{"admin"}, nil, http.StatusUnauthorized},
+	}
+	for i, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/company", nil)
+		if tc.claims != nil {
+			r = withClaims(r, tc.claims)
+		}
+		if w := serve(RequireRoles(tc.roles...)(ok), r); w.Code != tc.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestHandlerTimeoutWrapsRouteMiddleware(t *testing.T) {
+	returned := make(chan error, 1)
+	// records what the route middleware sees, as Idempotent does
+	record := func(handler HandlerWithError) HandlerWithError {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			err := handler(w, r)
+			returned <- err
+			return err
+		}
+	}
+	api := &API{
+		Spec: RouterSpec{"company-create": func(w http.ResponseWriter, r *http.Request) error {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		}},
+		Middleware: map[string][]Middleware{"company-create": {record}},
+	}
+	h := api.handler("/company", "company-create", map[string]RouteCfg{"company-create": {TimeoutMs: 10}}, 1<<20)
+	w := serve(h, httptest.NewRequest(http.MethodPost, "/company", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Errorf("route middleware got %v instead of the result of the handler", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("route middleware did not return")
+	}
+}
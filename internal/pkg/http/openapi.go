@@ -0,0 +1,310 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Param documents a path or query parameter of a route
+type Param struct {
+	Name        string
+	Description string
+	// Type is the JSON type of the parameter, string if empty
+	Type     string
+	Required bool
+}
+
+// RouteDoc documents the route of a handler. The schemas of the bodies are
+// derived from the types of Request and of the values of Responses.
+type RouteDoc struct {
+	Summary string
+	Tags    []string
+	// Path describes the variables of the route suffix, e.g. id1
+	Path  []Param
+	Query []Param
+	// Request is a value of the type of the application/json request body,
+	// nil for none
+	Request interface{}
+	// MediaTypes holds the request bodies of other media types
+	MediaTypes map[string]interface{}
+	// Responses maps the statuses of the route to a value of the type of
+	// their body, nil for none. Errors are documented as problems.
+	Responses map[int]interface{}
+}
+
+// APIDoc documents the service, its routes are documented by their Doc
+type APIDoc struct {
+	Title       string
+	Version     string
+	Description string
+}
+
+var pathVar = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// OpenAPI returns the OpenAPI 3 document of the routes of api served under
+// prefix and configured by routes, the routes requiring a jwt token are the
+// ones with JWTAuth or roles
+func (api *API) OpenAPI(prefix string, routes map[string]RouteCfg) map[string]interface{} {
+	g := &schemaGen{schemas: map[string]interface{}{}}
+	paths := map[string]interface{}{}
+	for _, p := range api.Layout.prefixes() {
+		for _, name := range api.Layout.names(p) {
+			route := api.Layout[p][name]
+			path := pathVar.ReplaceAllString(p+route.Suffix, "{$1}")
+			ops, ok := paths[path].(map[string]interface{})
+			if !ok {
+				ops = map[string]interface{}{}
+				paths[path] = ops
+			}
+			ops[strings.ToLower(route.Method)] = g.operation(name, path, route.Doc, api.authenticated(p, name, routes))
+		}
+	}
+	doc := api.Doc
+	if doc == nil {
+		doc = &APIDoc{}
+	}
+	g.schemas["Problem"] = problemSchema
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       doc.Title,
+			"version":     doc.Version,
+			"description": doc.Description,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/" + prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+var problemSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"type":           map[string]interface{}{"type": "string"},
+		"title":          map[string]interface{}{"type": "string"},
+		"status":         map[string]interface{}{"type": "integer"},
+		"code":           map[string]interface{}{"type": "string"},
+		"detail":         map[string]interface{}{"type": "string"},
+		"instance":       map[string]interface{}{"type": "string"},
+		"correlation_id": map[string]interface{}{"type": "string"},
+		"errors": map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"field":   map[string]interface{}{"type": "string"},
+					"message": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	},
+}
+
+// authenticated tells whether route name of prefix requires a jwt token, i.e.
+// whether JWTAuth is in its middleware or roles in its config
+func (api *API) authenticated(prefix string, name string, routes map[string]RouteCfg) bool {
+	jwtAuth := reflect.ValueOf(JWTAuth).Pointer()
+	for _, l := range [][]Middleware{api.Global, api.Middleware[prefix], api.Middleware[name]} {
+		for _, mw := range l {
+			if reflect.ValueOf(mw).Pointer() == jwtAuth {
+				return true
+			}
+		}
+	}
+	return len(routes[prefix].Roles) > 0 || len(routes[name].Roles) > 0
+}
+
+type schemaGen struct {
+	// named struct schemas, by type name
+	schemas map[string]interface{}
+}
+
+func (g *schemaGen) operation(name string, path string, d RouteDoc, auth bool) map[string]interface{} {
+	op := map[string]interface{}{"operationId": name}
+	if len(d.Summary) > 0 {
+		op["summary"] = d.Summary
+	}
+	if len(d.Tags) > 0 {
+		op["tags"] = d.Tags
+	}
+	if auth {
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+	params := []interface{}{}
+	for _, m := range pathVar.FindAllStringSubmatch(path, -1) {
+		p := Param{Name: m[1]}
+		for _, dp := range d.Path {
+			if dp.Name == m[1] {
+				p = dp
+			}
+		}
+		p.Required = true
+		params = append(params, parameter(p, "path"))
+	}
+	for _, p := range d.Query {
+		params = append(params, parameter(p, "query"))
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	content := map[string]interface{}{}
+	if d.Request != nil {
+		content["application/json"] = map[string]interface{}{"schema": g.schema(reflect.TypeOf(d.Request))}
+	}
+	for mt, v := range d.MediaTypes {
+		content[mt] = map[string]interface{}{"schema": g.schema(reflect.TypeOf(v))}
+	}
+	if len(content) > 0 {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+	responses := map[string]interface{}{}
+	for status, v := range d.Responses {
+		resp := map[string]interface{}{"description": http.StatusText(status)}
+		if v != nil {
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(v))},
+			}
+		}
+		responses[fmt.Sprint(status)] = resp
+	}
+	responses["default"] = map[string]interface{}{
+		"description": "error",
+		"content": map[string]interface{}{
+			MediaTypeProblem: map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"},
+			},
+		},
+	}
+	op["responses"] = responses
+	return op
+}
+
+func parameter(p Param, in string) map[string]interface{} {
+	t := p.Type
+	if len(t) == 0 {
+		t = "string"
+	}
+	m := map[string]interface{}{
+		"name":     p.Name,
+		"in":       in,
+		"required": p.Required,
+		"schema":   map[string]interface{}{"type": t},
+	}
+	if len(p.Description) > 0 {
+		m["description"] = p.Description
+	}
+	return m
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schema returns the JSON schema of the values of t as encoding/json
+// marshals them, exported structs are referenced from the components
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	case t.Kind() != reflect.Struct && t.Kind() != reflect.Pointer &&
+		(t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType)):
+		// enums, e.g. types.CompanyType, are marshalled as their name
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return s
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if !token.IsExported(t.Name()) {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// placeholder first, for recursive types
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	g.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
+
+// docsPage is the built-in docs page, rendering the OpenAPI document of the
+// service with Swagger UI
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
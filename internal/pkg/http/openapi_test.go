@@ -0,0 +1,71 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+)
+
+func testAPI() *API {
+	doc := RouteDoc{Summary: "test"}
+	return &API{
+		Layout: RouteLayout{
+			"/company": {
+				"company-get":    {Method: http.MethodGet, Suffix: "/{id1}", Doc: doc},
+				"company-insert": {Method: http.MethodPost, Suffix: "", Doc: doc},
+				"company-merge":  {Method: http.MethodPost, Suffix: "/merge", Doc: doc},
+			},
+			"/jobs": {
+				"job-list": {Method: http.MethodGet, Suffix: "", Doc: doc},
+			},
+		},
+		Spec: RouterSpec{"company-get": ok, "company-insert": ok, "company-merge": ok, "job-list": ok},
+		Middleware: map[string][]Middleware{
+			"/jobs":          {JWTAuth},
+			"company-insert": {RateLimit(1, 1), JWTAuth},
+		},
+		Doc: &APIDoc{Title: "test"},
+	}
+}
+
+func TestOpenAPIAuth(t *testing.T) {
+	routes := map[string]RouteCfg{"company-merge": {Roles: []string{"admin"}}}
+	paths := testAPI().OpenAPI("test", routes)["paths"].(map[string]interface{})
+	tests := []struct {
+		path     string
+		method   string
+		expected bool
+	}{
+		{"/company/{id1}", "get", false},
+		{"/company", "post", true},
+		{"/company/merge", "post", true},
+		{"/jobs", "get", true},
+	}
+	for i, tc := range tests {
+		op := paths[tc.path].(map[string]interface{})[tc.method].(map[string]interface{})
+		if _, auth := op["security"]; auth != tc.expected {
+			t.Errorf("test %d: expected auth %v, got %v", i, tc.expected, auth)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		change func(api *API)
+		ok     bool
+	}{
+		{func(api *API) {}, true},
+		{func(api *API) {
+			api.Layout["/jobs"]["job-list"] = Route{Method: http.MethodGet}
+		}, false},
+		{func(api *API) { delete(api.Spec, "job-list") }, false},
+		{func(api *API) { api.Spec["job-get"] = ok }, false},
+		{func(api *API) { api.Middleware["job-get"] = []Middleware{JWTAuth} }, false},
+	}
+	for i, tc := range tests {
+		api := testAPI()
+		tc.change(api)
+		if err := api.validate(nil); (err == nil) != tc.ok {
+			t.Errorf("test %d: expected ok %v, got %v", i, tc.ok, err)
+		}
+	}
+}
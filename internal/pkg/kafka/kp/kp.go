@@ -3,9 +3,16 @@ package kp
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jmakaron/compman/internal/pkg/requestid"
 )
 
 const (
@@ -14,6 +21,8 @@ const (
 	baseDelay     = 100 * time.Millisecond
 )
 
+var ErrNotConnected = errors.New("producer not connected")
+
 type KEvent interface {
 	Topic() *string
 	Key() []byte
@@ -44,9 +53,14 @@ type ProducerCfg struct {
 
 type KafkaProducer interface {
 	Connect(context.Context) error
-	Disconnect()
-	Publish(...KEvent) error
-	PublishWithRetry(...KEvent) error
+	// Disconnect flushes the queued events until ctx is done
+	Disconnect(context.Context) error
+	// Publish produces the events, with the request id of ctx as a header
+	Publish(context.Context, ...KEvent) error
+	PublishWithRetry(context.Context, ...KEvent) error
+	// Ping requests the metadata of the cluster, failing if no broker
+	// answers before ctx is done
+	Ping(context.Context) error
 }
 
 type kafkaProducer struct {
@@ -76,22 +90,81 @@ func (p *kafkaProducer) Connect(ctx context.Context) error {
 	return nil
 }
 
-func (p *kafkaProducer) PublishWithRetry(evts ...KEvent) error {
+func (p *kafkaProducer) PublishWithRetry(ctx context.Context, evts ...KEvent) error {
 	var err error
 	for r := 0; r < maxRetries; r++ {
 		if err != nil {
 			exp := 1 << uint(r-1)
 			currentDelay := time.Duration(float64(baseDelay) * (backoffFactor - 1.0) * float64(exp))
 			time.Sleep(currentDelay)
+			publishRetries.Inc()
 		}
-		if err = p.Publish(evts...); err == nil {
+		if err = p.Publish(ctx, evts...); err == nil {
 			break
 		}
 	}
+	if err != nil {
+		publishedEvents.WithLabelValues("failure").Add(float64(len(evts)))
+	} else {
+		publishedEvents.WithLabelValues("success").Add(float64(len(evts)))
+	}
 	return err
 }
 
-func (p *kafkaProducer) Publish(evts ...KEvent) error {
+// headerCarrier injects the trace context of a span in the headers of a message
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	l := make([]string, len(*c.headers))
+	for i, h := range *c.headers {
+		l[i] = h.Key
+	}
+	return l
+}
+
+// message returns the message of e with the request id of ctx and the
+// traceparent of its produce span, ended once the message is delivered
+func message(ctx context.Context, e KEvent) *kafka.Message {
+	ctx, span := tracer.Start(ctx, "kafka produce "+*e.Topic(), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(semconv.MessagingSystemKafka, semconv.MessagingDestinationName(*e.Topic())))
+	headers := []kafka.Header{}
+	if id := requestid.From(ctx); len(id) > 0 {
+		headers = append(headers, kafka.Header{Key: requestid.Header, Value: []byte(id)})
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{&headers})
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Partition: kafka.PartitionAny, Topic: e.Topic()},
+		Value: e.Value(), Key: e.Key(), Headers: headers, Opaque: span}
+}
+
+// endSpan ends the produce span of the message, failing with err
+func endSpan(m *kafka.Message, err error) {
+	span, ok := m.Opaque.(trace.Span)
+	if !ok {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (p *kafkaProducer) Publish(ctx context.Context, evts ...KEvent) error {
 	respCh := make(chan kafka.Event, len(evts))
 	errCh := make(chan error, len(evts))
 	var err error
@@ -101,10 +174,10 @@ func (p *kafkaProducer) Publish(evts ...KEvent) error {
 		case <-p.ctx.Done():
 			err = p.ctx.Err()
 		default:
-			err = p.p.Produce(
-				&kafka.Message{TopicPartition: kafka.TopicPartition{
-					Partition: kafka.PartitionAny, Topic: e.Topic()}, Value: e.Value(), Key: e.Key()},
-				respCh)
+			m := message(ctx, e)
+			if err = p.p.Produce(m, respCh); err != nil {
+				endSpan(m, err)
+			}
 		}
 		if err != nil {
 			total = idx
@@ -129,6 +202,7 @@ func (p *kafkaProducer) Publish(evts ...KEvent) error {
 					err = t
 				case *kafka.Message:
 					err = t.TopicPartition.Error
+					endSpan(t, err)
 				}
 				if err != nil {
 					errCh <- err
@@ -145,15 +219,53 @@ func (p *kafkaProducer) Publish(evts ...KEvent) error {
 	return err
 }
 
-func (p *kafkaProducer) Disconnect() {
-	p.cancel()
-	rem := p.p.Flush(5000)
-	for i := 0; i < rem; i++ {
-		<-p.p.Events()
+const (
+	// defaultPingTimeout bounds the metadata request of Ping, and
+	// defaultFlushTimeout the delivery of the queued events on Disconnect, for
+	// contexts without deadline
+	defaultPingTimeout  = 5 * time.Second
+	defaultFlushTimeout = 5 * time.Second
+)
+
+// timeoutMs returns the time left until the deadline of ctx in ms, def if it
+// has none
+func timeoutMs(ctx context.Context, def time.Duration) int {
+	timeout := def
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout < 0 {
+		return 0
+	}
+	return int(timeout.Milliseconds())
+}
+
+func (p *kafkaProducer) Ping(ctx context.Context) error {
+	if p.p == nil {
+		return ErrNotConnected
+	}
+	ms := timeoutMs(ctx, defaultPingTimeout)
+	if ms == 0 {
+		return context.DeadlineExceeded
 	}
+	_, err := p.p.GetMetadata(nil, false, ms)
+	return err
+}
+
+// Disconnect delivers the queued events until the deadline of ctx and closes
+// the producer, it fails with the number of events left undelivered
+func (p *kafkaProducer) Disconnect(ctx context.Context) error {
+	rem := p.p.Flush(timeoutMs(ctx, defaultFlushTimeout))
+	p.cancel()
 	p.p.Close()
+	if rem > 0 {
+		return fmt.Errorf("%d events not delivered", rem)
+	}
+	return nil
 }
 
+var tracer = otel.Tracer("github.com/jmakaron/compman/internal/pkg/kafka/kp")
+
 func New(cfg ProducerCfg) KafkaProducer {
 	return &kafkaProducer{cfg: cfg}
 }
@@ -88,10 +88,10 @@ func TestKafkaIntegration(t *testing.T) {
 		e, _ = types.NewKafkaCompanyEvent(d, op)
 		evts[i] = e
 	}
-	if err := p.PublishWithRetry(evts...); err != nil {
+	if err := p.PublishWithRetry(ctx, evts...); err != nil {
 		t.Fatalf("failed to publish messages to kafka with retries, %+v", err)
 	}
-	defer p.Disconnect()
+	defer p.Disconnect(ctx)
 	sentKeys := map[string]struct{}{}
 	for _, d := range data {
 		sentKeys[d.ID] = struct{}{}
@@ -0,0 +1,19 @@
+package kp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// publishedEvents counts the events of PublishWithRetry, by result
+	// (success, failure)
+	publishedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_published_events_total",
+		Help: "Events published to kafka, by result.",
+	}, []string{"result"})
+	publishRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_publish_retries_total",
+		Help: "Retried attempts to publish events to kafka.",
+	})
+)
@@ -0,0 +1,24 @@
+package requestid
+
+import "context"
+
+// Header carries the request id in http requests, responses and kafka
+// messages
+const Header = "X-Request-ID"
+
+type ctxKey int
+
+const idKey ctxKey = iota
+
+// With returns a copy of ctx carrying the request id
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey, id)
+}
+
+// From returns the request id of ctx, empty if there is none
+func From(ctx context.Context) string {
+	if v, ok := ctx.Value(idKey).(string); ok {
+		return v
+	}
+	return ""
+}